@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sync/singleflight"
+)
+
+// cachedGatherer shares the gathered families between the scrapes for the ttl, e.g. of the HA scraper pairs, trading
+// a bit of staleness for the collection cost of the big registries. The concurrent scrapes of an expired cache
+// wait for a single gather instead of gathering on their own.
+type cachedGatherer struct {
+	g     prometheus.Gatherer
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.Mutex
+	last    gathered
+	expires time.Time
+}
+
+// gathered is the result of a single gather, the error is partial, it comes along with the gathered families.
+type gathered struct {
+	mfs []*dto.MetricFamily
+	err error
+}
+
+func newCachedGatherer(g prometheus.Gatherer, ttl time.Duration) *cachedGatherer {
+	return &cachedGatherer{g: g, ttl: ttl}
+}
+
+// Gather returns the cached families while they are fresh. The families are shared, so they should not be modified.
+func (c *cachedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	if time.Now().Before(c.expires) {
+		last := c.last
+		c.mu.Unlock()
+		return last.mfs, last.err
+	}
+	c.mu.Unlock()
+
+	v, _, _ := c.group.Do("gather", func() (any, error) {
+		mfs, err := c.g.Gather()
+		last := gathered{mfs: mfs, err: err}
+
+		c.mu.Lock()
+		c.last, c.expires = last, time.Now().Add(c.ttl)
+		c.mu.Unlock()
+
+		return last, nil
+	})
+
+	last := v.(gathered)
+	return last.mfs, last.err
+}
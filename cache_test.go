@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CachedGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."})
+	reg.MustRegister(counter)
+
+	var gathers atomic.Int32
+	g := newCachedGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathers.Add(1)
+		// a slow registry, so the scrapes overlap
+		time.Sleep(time.Millisecond * 50)
+		return reg.Gather()
+	}), time.Millisecond*200)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mfs, err := g.Gather()
+			assert.NoError(t, err)
+			assert.Len(t, mfs, 1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), gathers.Load())
+
+	// stale until the ttl expires
+	counter.Inc()
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), mfs[0].GetMetric()[0].GetCounter().GetValue())
+
+	require.Eventually(t, func() bool {
+		mfs, err := g.Gather()
+		return err == nil && mfs[0].GetMetric()[0].GetCounter().GetValue() == 1
+	}, time.Second*5, time.Millisecond*50)
+	assert.Equal(t, int32(2), gathers.Load())
+
+	assert.Error(t, (&Config{ScrapeCacheTTL: -time.Second}).validate())
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	stderr "errors"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// ErrorCode is a stable machine-readable code of the RPC error. The workers receive only the error message,
+// so the code is a part of it in the `[code]` form, e.g. `[undefined_collector] undefined collector requests`.
+type ErrorCode string
+
+const (
+	// CodeUndefinedCollector is returned for the collectors which were not declared (yet), Declare and retry.
+	CodeUndefinedCollector ErrorCode = "undefined_collector"
+	// CodeInvalidLabels is returned for the missing, conflicting or invalid label values.
+	CodeInvalidLabels ErrorCode = "invalid_labels"
+	// CodeCardinalityLimit is returned when a new series would exceed the max_cardinality of the collector.
+	CodeCardinalityLimit ErrorCode = "cardinality_limit"
+	// CodeUnsupportedMethod is returned when the collector type does not support the called method.
+	CodeUnsupportedMethod ErrorCode = "unsupported_method"
+	// CodeInvalidValue is returned for the values the collector can't take, e.g. a negative duration.
+	CodeInvalidValue ErrorCode = "invalid_value"
+	// CodeInvalidExemplar is returned for the exemplars which are invalid or not supported by the collector.
+	CodeInvalidExemplar ErrorCode = "invalid_exemplar"
+	// CodeInvalidCollector is returned for the invalid collector definitions.
+	CodeInvalidCollector ErrorCode = "invalid_collector"
+	// CodeUndefinedRegistry is returned for the named registries which do not exist (anymore).
+	CodeUndefinedRegistry ErrorCode = "undefined_registry"
+	// CodeRegistry is returned when the prometheus registry rejects the (un)registration, e.g. on a name conflict.
+	CodeRegistry ErrorCode = "registry_error"
+)
+
+// codedError attaches the code to the error.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func withCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &codedError{code: code, err: err}
+}
+
+func (e *codedError) Error() string {
+	return "[" + string(e.code) + "] " + e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// Code returns the code of the RPC error, empty when the error has no code.
+func Code(err error) ErrorCode {
+	for err != nil {
+		var ce *codedError
+		if stderr.As(err, &ce) {
+			return ce.code
+		}
+
+		// errors.E does not unwrap
+		e, ok := err.(*errors.Error)
+		if !ok {
+			return ""
+		}
+		err = e.Err
+	}
+
+	return ""
+}
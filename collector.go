@@ -0,0 +1,786 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/model"
+)
+
+// newCollector creates a prometheus collector from its description.
+func newCollector(name string, m *Collector) (prometheus.Collector, error) {
+	err := validateNames(name, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Const) != 0 {
+		promCol, err := newConstCollector(name, m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid const collector `%s`: %w", name, err)
+		}
+
+		return promCol, nil
+	}
+
+	var promCol prometheus.Collector
+	switch m.Type {
+	case Histogram:
+		err = m.validateNativeHistogram()
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram `%s`: %w", name, err)
+		}
+
+		err = validateBuckets(m.Buckets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram `%s`: %w", name, err)
+		}
+
+		buckets, err := m.BucketsGenerator.append(m.Buckets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram `%s`: %w", name, err)
+		}
+
+		// native histograms without the explicit buckets have no classic buckets at all
+		if len(buckets) == 0 && !m.nativeHistogram() {
+			buckets = slices.Clone(prometheus.DefBuckets)
+		}
+
+		opts := prometheus.HistogramOpts{
+			Name:                            name,
+			Namespace:                       m.Namespace,
+			Subsystem:                       m.Subsystem,
+			Help:                            m.Help,
+			ConstLabels:                     m.ConstLabels,
+			Buckets:                         buckets,
+			NativeHistogramBucketFactor:     m.NativeHistogramBucketFactor,
+			NativeHistogramMaxBucketNumber:  m.NativeHistogramMaxBucketNumber,
+			NativeHistogramMinResetDuration: m.NativeHistogramMinResetDuration,
+		}
+
+		if len(m.Labels) != 0 {
+			promCol = prometheus.NewHistogramVec(opts, m.Labels)
+		} else {
+			promCol = prometheus.NewHistogram(opts)
+		}
+	case Gauge:
+		opts := prometheus.GaugeOpts{
+			Name:        name,
+			Namespace:   m.Namespace,
+			Subsystem:   m.Subsystem,
+			Help:        m.Help,
+			ConstLabels: m.ConstLabels,
+		}
+
+		if len(m.Labels) != 0 {
+			promCol = prometheus.NewGaugeVec(opts, m.Labels)
+		} else {
+			promCol = prometheus.NewGauge(opts)
+		}
+	case Counter:
+		opts := prometheus.CounterOpts{
+			Name:        name,
+			Namespace:   m.Namespace,
+			Subsystem:   m.Subsystem,
+			Help:        m.Help,
+			ConstLabels: m.ConstLabels,
+		}
+
+		if len(m.Labels) != 0 {
+			promCol = prometheus.NewCounterVec(opts, m.Labels)
+		} else {
+			promCol = prometheus.NewCounter(opts)
+		}
+	case Summary:
+		if m.MaxAge < 0 {
+			return nil, fmt.Errorf("invalid summary `%s`: max_age should not be negative", name)
+		}
+
+		err = validateObjectives(m.Objectives)
+		if err != nil {
+			return nil, fmt.Errorf("invalid summary `%s`: %w", name, err)
+		}
+
+		opts := prometheus.SummaryOpts{
+			Name:        name,
+			Namespace:   m.Namespace,
+			Subsystem:   m.Subsystem,
+			Help:        m.Help,
+			ConstLabels: m.ConstLabels,
+			Objectives:  m.Objectives,
+			MaxAge:      m.MaxAge,
+			AgeBuckets:  m.AgeBuckets,
+			BufCap:      m.BufCap,
+		}
+
+		if len(m.Labels) != 0 {
+			promCol = prometheus.NewSummaryVec(opts, m.Labels)
+		} else {
+			promCol = prometheus.NewSummary(opts)
+		}
+
+		if m.MirrorAsHistogram != nil {
+			promCol, err = mirrorAsHistogram(promCol, name, m)
+			if err != nil {
+				return nil, fmt.Errorf("invalid summary `%s`: %w", name, err)
+			}
+		}
+	case GaugeFunc:
+		if len(m.Labels) != 0 {
+			return nil, fmt.Errorf("invalid gauge_func `%s`: labels are not supported", name)
+		}
+
+		promCol = newGaugeFunc(prometheus.GaugeOpts{
+			Name:        name,
+			Namespace:   m.Namespace,
+			Subsystem:   m.Subsystem,
+			Help:        m.Help,
+			ConstLabels: m.ConstLabels,
+		})
+	case Info:
+		if len(m.Labels) == 0 {
+			return nil, fmt.Errorf("invalid info `%s`: labels are required", name)
+		}
+
+		i := newInfo(prometheus.GaugeOpts{
+			Name:        name,
+			Namespace:   m.Namespace,
+			Subsystem:   m.Subsystem,
+			Help:        m.Help,
+			ConstLabels: m.ConstLabels,
+		}, m.Labels)
+
+		if len(m.Info) != 0 {
+			values := make([]string, 0, len(m.Labels))
+			for _, label := range m.Labels {
+				v, ok := m.Info[label]
+				if !ok {
+					return nil, fmt.Errorf("invalid info `%s`: missing value of the label `%s`", name, label)
+				}
+				values = append(values, v)
+			}
+
+			if len(m.Info) != len(m.Labels) {
+				return nil, fmt.Errorf("invalid info `%s`: info should contain exactly the declared labels", name)
+			}
+
+			err = i.Set(values)
+			if err != nil {
+				return nil, fmt.Errorf("invalid info `%s`: %w", name, err)
+			}
+		}
+
+		promCol = i
+	default:
+		return nil, fmt.Errorf("invalid metric type `%s` for `%s`", m.Type, name)
+	}
+
+	if m.MirrorAsHistogram != nil && m.Type != Summary {
+		return nil, fmt.Errorf("mirror_as_histogram of `%s` is only supported by summaries", name)
+	}
+
+	return promCol, nil
+}
+
+// validateCollector checks the collector definition by building it, prometheus panics on some invalid definitions.
+func validateCollector(name string, m *Collector) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("invalid collector `%s`: %v", name, rec)
+		}
+	}()
+
+	_, err = newCollector(name, m)
+	return err
+}
+
+// sanitizeMetricName replaces the characters which are not allowed in the metric names with underscores, a name
+// starting with a digit is prefixed with an underscore, e.g. `http.requests-total` becomes `http_requests_total`.
+func sanitizeMetricName(name string) string {
+	if name == "" || model.IsValidLegacyMetricName(name) {
+		return name
+	}
+
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// validateNames checks the metric and label names, so naming bugs are reported on declaration instead of on the first scrape.
+func validateNames(name string, m *Collector) error {
+	if !model.IsValidLegacyMetricName(name) {
+		return fmt.Errorf("invalid metric name `%s`, should match %s", name, model.MetricNameRE)
+	}
+
+	if m.Namespace != "" && !model.IsValidLegacyMetricName(m.Namespace) {
+		return fmt.Errorf("invalid namespace `%s` for `%s`, should match %s", m.Namespace, name, model.MetricNameRE)
+	}
+
+	if m.Subsystem != "" && !model.IsValidLegacyMetricName(m.Subsystem) {
+		return fmt.Errorf("invalid subsystem `%s` for `%s`, should match %s", m.Subsystem, name, model.MetricNameRE)
+	}
+
+	for _, label := range m.Labels {
+		err := validateLabelName(label)
+		if err != nil {
+			return fmt.Errorf("invalid label for `%s`: %w", name, err)
+		}
+	}
+
+	for label := range m.ConstLabels {
+		err := validateLabelName(label)
+		if err != nil {
+			return fmt.Errorf("invalid const label for `%s`: %w", name, err)
+		}
+	}
+
+	err := validateTTL(name, m)
+	if err != nil {
+		return err
+	}
+
+	err = validateCardinality(name, m)
+	if err != nil {
+		return err
+	}
+
+	err = validateInitial(name, m)
+	if err != nil {
+		return err
+	}
+
+	return validateEnum(name, m)
+}
+
+func validateTTL(name string, m *Collector) error {
+	if m.TTL < 0 || m.SweepInterval < 0 {
+		return fmt.Errorf("ttl and sweep_interval of `%s` should not be negative", name)
+	}
+
+	if m.TTL > 0 && len(m.Labels) == 0 {
+		return fmt.Errorf("ttl of `%s` requires labels, only the series of vector collectors expire", name)
+	}
+
+	// the info replaces its only series on Set, there is nothing to expire
+	if m.TTL > 0 && len(m.Const) != 0 {
+		return fmt.Errorf("ttl of `%s` is not supported by the const collectors, their series are fixed", name)
+	}
+
+	if m.TTL > 0 && m.Type == Info {
+		return fmt.Errorf("ttl of `%s` is not supported by the info collectors", name)
+	}
+
+	if m.TTL == 0 && m.SweepInterval > 0 {
+		return fmt.Errorf("sweep_interval of `%s` requires ttl", name)
+	}
+
+	return nil
+}
+
+func validateCardinality(name string, m *Collector) error {
+	if m.MaxCardinality < 0 {
+		return fmt.Errorf("max_cardinality of `%s` should not be negative", name)
+	}
+
+	if m.MaxCardinality > 0 && len(m.Labels) == 0 {
+		return fmt.Errorf("max_cardinality of `%s` requires labels, only the vector collectors have multiple series", name)
+	}
+
+	if m.MaxCardinality > 0 && len(m.Const) != 0 {
+		return fmt.Errorf("max_cardinality of `%s` is not supported by the const collectors, their series are fixed", name)
+	}
+
+	if m.MaxCardinality > 0 && m.Type == Info {
+		return fmt.Errorf("max_cardinality of `%s` is not supported by the info collectors, they expose a single series", name)
+	}
+
+	return nil
+}
+
+func validateInitial(name string, m *Collector) error {
+	if m.InitialValue == 0 && len(m.InitialLabels) == 0 {
+		return nil
+	}
+
+	if (m.Type != Gauge && m.Type != Counter) || len(m.Const) != 0 {
+		return fmt.Errorf("initial_value and initial_labels of `%s` are supported by the gauges and counters only", name)
+	}
+
+	if m.Type == Counter && m.InitialValue < 0 {
+		return fmt.Errorf("initial_value of the counter `%s` should not be negative", name)
+	}
+
+	if len(m.InitialLabels) > 0 && len(m.Labels) == 0 {
+		return fmt.Errorf("initial_labels of `%s` require labels", name)
+	}
+
+	if m.MaxCardinality > 0 && len(m.InitialLabels) > m.MaxCardinality {
+		return fmt.Errorf("initial_labels of `%s` exceed its max_cardinality %d", name, m.MaxCardinality)
+	}
+
+	for _, values := range m.InitialLabels {
+		if len(values) != len(m.Labels) {
+			return fmt.Errorf("initial_labels %v of `%s` should have the values of all labels %v", values, name, m.Labels)
+		}
+	}
+
+	return nil
+}
+
+func validateEnum(name string, m *Collector) error {
+	if m.Enum == nil {
+		return nil
+	}
+
+	if m.Type != Gauge || len(m.Const) != 0 {
+		return fmt.Errorf("enum of `%s` is supported by the gauges only", name)
+	}
+
+	if !slices.Contains(m.Labels, m.Enum.Label) {
+		return fmt.Errorf("enum label `%s` of `%s` should be one of its labels %v", m.Enum.Label, name, m.Labels)
+	}
+
+	if len(m.Enum.States) == 0 {
+		return fmt.Errorf("enum of `%s` should have states", name)
+	}
+
+	for i, state := range m.Enum.States {
+		if slices.Contains(m.Enum.States[:i], state) {
+			return fmt.Errorf("enum of `%s` has duplicate state `%s`", name, state)
+		}
+	}
+
+	return nil
+}
+
+func validateLabelName(label string) error {
+	if !model.LabelName(label).IsValidLegacy() {
+		return fmt.Errorf("label name `%s` should match %s", label, model.LabelNameRE)
+	}
+
+	if strings.HasPrefix(label, model.ReservedLabelPrefix) {
+		return fmt.Errorf("label name `%s` should not start with the reserved `%s` prefix", label, model.ReservedLabelPrefix)
+	}
+
+	return nil
+}
+
+// validateBuckets checks that the buckets are strictly increasing, prometheus only finds that out at scrape time.
+// Empty buckets are allowed, the default ones are used in that case.
+func validateBuckets(buckets []float64) error {
+	for i, b := range buckets {
+		if math.IsNaN(b) {
+			return fmt.Errorf("bucket #%d is NaN", i)
+		}
+
+		if math.IsInf(b, 1) {
+			return fmt.Errorf("bucket #%d is +Inf, it is added implicitly", i)
+		}
+
+		if i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("buckets should be in strictly increasing order, bucket #%d (%v) is not greater than %v", i, b, buckets[i-1])
+		}
+	}
+
+	return nil
+}
+
+// append the generated buckets to the explicit ones, keeping them sorted and unique. Nil generator returns the buckets as is.
+func (g *BucketsGenerator) append(buckets []float64) ([]float64, error) {
+	if g == nil {
+		return buckets, nil
+	}
+
+	if g.Count <= 0 {
+		return nil, fmt.Errorf("buckets_generator: count should be positive")
+	}
+
+	var generated []float64
+	switch g.Type {
+	case LinearBuckets:
+		if g.Width <= 0 {
+			return nil, fmt.Errorf("buckets_generator: width of the linear buckets should be positive")
+		}
+
+		generated = prometheus.LinearBuckets(g.Start, g.Width, g.Count)
+	case ExponentialBuckets:
+		if g.Start <= 0 {
+			return nil, fmt.Errorf("buckets_generator: start of the exponential buckets should be positive")
+		}
+
+		if g.Factor <= 1 {
+			return nil, fmt.Errorf("buckets_generator: factor of the exponential buckets should be greater than 1")
+		}
+
+		generated = prometheus.ExponentialBuckets(g.Start, g.Factor, g.Count)
+	default:
+		return nil, fmt.Errorf("buckets_generator: unknown type `%s`, should be linear or exponential", g.Type)
+	}
+
+	all := append(slices.Clone(buckets), generated...)
+	slices.Sort(all)
+	all = slices.Compact(all)
+
+	return all, validateBuckets(all)
+}
+
+// validateObjectives checks that the quantiles are in (0,1] and the allowed errors are in [0,1).
+func validateObjectives(objectives map[float64]float64) error {
+	for quantile, allowedErr := range objectives {
+		if math.IsNaN(quantile) || quantile <= 0 || quantile > 1 {
+			return fmt.Errorf("objective quantile %v should be in (0,1]", quantile)
+		}
+
+		if math.IsNaN(allowedErr) || allowedErr < 0 || allowedErr >= 1 {
+			return fmt.Errorf("objective %v: allowed error %v should be in [0,1)", quantile, allowedErr)
+		}
+	}
+
+	return nil
+}
+
+// nativeHistogram reports whether native (sparse) buckets are requested for the histogram.
+func (m *Collector) nativeHistogram() bool {
+	return m.NativeHistogramBucketFactor != 0
+}
+
+// validateNativeHistogram checks that the native histogram options are consistent.
+func (m *Collector) validateNativeHistogram() error {
+	if !m.nativeHistogram() {
+		if m.NativeHistogramMaxBucketNumber != 0 || m.NativeHistogramMinResetDuration != 0 {
+			return fmt.Errorf("native histogram options require native_histogram_bucket_factor to be set")
+		}
+
+		return nil
+	}
+
+	if m.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("native_histogram_bucket_factor should be greater than 1, got %v", m.NativeHistogramBucketFactor)
+	}
+
+	if m.NativeHistogramMinResetDuration < 0 {
+		return fmt.Errorf("native_histogram_min_reset_duration should not be negative")
+	}
+
+	return nil
+}
+
+// gaugeFunc is a GaugeFunc whose value is cached by the plugin and refreshed by the workers via the Set RPC.
+// Prometheus reads the cached value at scrape time.
+type gaugeFunc struct {
+	prometheus.GaugeFunc
+	// float64 bits
+	value atomic.Uint64
+}
+
+func newGaugeFunc(opts prometheus.GaugeOpts) *gaugeFunc {
+	g := &gaugeFunc{}
+	g.GaugeFunc = prometheus.NewGaugeFunc(opts, g.load)
+	return g
+}
+
+// Set replaces the cached value.
+func (g *gaugeFunc) Set(v float64) {
+	g.value.Store(math.Float64bits(v))
+}
+
+func (g *gaugeFunc) load() float64 {
+	return math.Float64frombits(g.value.Load())
+}
+
+// mirrorAsHistogram pairs the summary with the histogram under the suffixed name, so both are registered, exposed
+// and observed together while the dashboards migrate from the (non-aggregatable) summary quantiles.
+func mirrorAsHistogram(summary prometheus.Collector, name string, m *Collector) (prometheus.Collector, error) {
+	suffix := m.MirrorAsHistogram.suffix()
+
+	if !model.IsValidLegacyMetricName(name + suffix) {
+		return nil, fmt.Errorf("invalid mirror_as_histogram suffix `%s`", suffix)
+	}
+
+	buckets := m.MirrorAsHistogram.Buckets
+	if len(buckets) == 0 {
+		buckets = slices.Clone(prometheus.DefBuckets)
+	}
+
+	err := validateBuckets(buckets)
+	if err != nil {
+		return nil, fmt.Errorf("mirror_as_histogram: %w", err)
+	}
+
+	opts := prometheus.HistogramOpts{
+		Name:        name + suffix,
+		Namespace:   m.Namespace,
+		Subsystem:   m.Subsystem,
+		Help:        m.Help,
+		ConstLabels: m.ConstLabels,
+		Buckets:     buckets,
+	}
+
+	if vec, ok := summary.(*prometheus.SummaryVec); ok {
+		return &mirroredSummaryVec{SummaryVec: vec, hist: prometheus.NewHistogramVec(opts, m.Labels)}, nil
+	}
+
+	return &mirroredSummary{Summary: summary.(prometheus.Summary), hist: prometheus.NewHistogram(opts)}, nil
+}
+
+// mirroredSummary observes into the summary and its histogram mirror.
+type mirroredSummary struct {
+	prometheus.Summary
+	hist prometheus.Histogram
+}
+
+func (s *mirroredSummary) Observe(v float64) {
+	s.Summary.Observe(v)
+	s.hist.Observe(v)
+}
+
+func (s *mirroredSummary) Describe(ch chan<- *prometheus.Desc) {
+	s.Summary.Describe(ch)
+	s.hist.Describe(ch)
+}
+
+func (s *mirroredSummary) Collect(ch chan<- prometheus.Metric) {
+	s.Summary.Collect(ch)
+	s.hist.Collect(ch)
+}
+
+// mirroredSummaryVec observes into the children of the summary and its histogram mirror.
+type mirroredSummaryVec struct {
+	*prometheus.SummaryVec
+	hist *prometheus.HistogramVec
+}
+
+func (s *mirroredSummaryVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Observer, error) {
+	summary, err := s.SummaryVec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		return nil, err
+	}
+
+	hist, err := s.hist.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return observers{summary, hist}, nil
+}
+
+func (s *mirroredSummaryVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	summary, err := s.SummaryVec.GetMetricWith(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	hist, err := s.hist.GetMetricWith(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return observers{summary, hist}, nil
+}
+
+func (s *mirroredSummaryVec) DeleteLabelValues(lvs ...string) bool {
+	deleted := s.SummaryVec.DeleteLabelValues(lvs...)
+	return s.hist.DeleteLabelValues(lvs...) || deleted
+}
+
+func (s *mirroredSummaryVec) Describe(ch chan<- *prometheus.Desc) {
+	s.SummaryVec.Describe(ch)
+	s.hist.Describe(ch)
+}
+
+func (s *mirroredSummaryVec) Collect(ch chan<- prometheus.Metric) {
+	s.SummaryVec.Collect(ch)
+	s.hist.Collect(ch)
+}
+
+// observers fan out the observation.
+type observers []prometheus.Observer
+
+func (o observers) Observe(v float64) {
+	for _, obs := range o {
+		obs.Observe(v)
+	}
+}
+
+// constCollector exposes the fixed metrics of a single descriptor.
+type constCollector struct {
+	desc    *prometheus.Desc
+	metrics []prometheus.Metric
+}
+
+func (c *constCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+// newConstCollector builds the immutable samples of the gauge or counter.
+func newConstCollector(name string, m *Collector) (prometheus.Collector, error) {
+	var valueType prometheus.ValueType
+	switch m.Type {
+	case Gauge:
+		valueType = prometheus.GaugeValue
+	case Counter:
+		valueType = prometheus.CounterValue
+	default:
+		return nil, fmt.Errorf("only gauges and counters might be const, got `%s`", m.Type)
+	}
+
+	desc := prometheus.NewDesc(prometheus.BuildFQName(m.Namespace, m.Subsystem, name), m.Help, m.Labels, m.ConstLabels)
+
+	c := &constCollector{desc: desc, metrics: make([]prometheus.Metric, 0, len(m.Const))}
+	seen := make(map[string]struct{}, len(m.Const))
+	for i, sample := range m.Const {
+		if len(sample.Labels) != len(m.Labels) {
+			return nil, fmt.Errorf("sample #%d should have the labels %v, got %v", i, m.Labels, sample.Labels)
+		}
+
+		values := make([]string, 0, len(m.Labels))
+		for _, label := range m.Labels {
+			v, ok := sample.Labels[label]
+			if !ok {
+				return nil, fmt.Errorf("sample #%d misses the label `%s`", i, label)
+			}
+			values = append(values, v)
+		}
+
+		key := seriesKey(values)
+		if _, ok := seen[key]; ok {
+			return nil, fmt.Errorf("sample #%d duplicates the labels %v", i, values)
+		}
+		seen[key] = struct{}{}
+
+		metric, err := prometheus.NewConstMetric(desc, valueType, sample.Value, values...)
+		if err != nil {
+			return nil, fmt.Errorf("sample #%d: %w", i, err)
+		}
+
+		c.metrics = append(c.metrics, metric)
+	}
+
+	return c, nil
+}
+
+// newTargetInfo exposes the labels as the target_info resource metric of the OpenMetrics convention.
+func newTargetInfo(labels map[string]string) (prometheus.Collector, error) {
+	desc := prometheus.NewDesc("target_info", "Target metadata.", nil, labels)
+	m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &constCollector{desc: desc, metrics: []prometheus.Metric{m}}, nil
+}
+
+// info is a gauge vector exposing a single series fixed at 1.
+type info struct {
+	*prometheus.GaugeVec
+
+	mu      sync.Mutex
+	current []string
+}
+
+func newInfo(opts prometheus.GaugeOpts, labels []string) *info {
+	return &info{GaugeVec: prometheus.NewGaugeVec(opts, labels)}
+}
+
+// Set replaces the exposed label set.
+func (i *info) Set(values []string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	g, err := i.GetMetricWithLabelValues(values...)
+	if err != nil {
+		return err
+	}
+
+	g.Set(1)
+	if i.current != nil && !slices.Equal(i.current, values) {
+		i.DeleteLabelValues(i.current...)
+	}
+
+	i.current = slices.Clone(values)
+	return nil
+}
+
+// newGoCollector creates the default Go collector, the lean default set is used when cfg is nil.
+func newGoCollector(cfg *GoCollector) (prometheus.Collector, error) {
+	if cfg == nil {
+		return collectors.NewGoCollector(), nil
+	}
+
+	rules := make([]collectors.GoRuntimeMetricsRule, 0, len(cfg.RuntimeMetrics)+len(cfg.Include))
+	for _, group := range cfg.RuntimeMetrics {
+		switch group {
+		case "all":
+			rules = append(rules, collectors.MetricsAll)
+		case "gc":
+			rules = append(rules, collectors.MetricsGC)
+		case "memory":
+			rules = append(rules, collectors.MetricsMemory)
+		case "scheduler":
+			rules = append(rules, collectors.MetricsScheduler)
+		case "debug":
+			rules = append(rules, collectors.MetricsDebug)
+		default:
+			return nil, fmt.Errorf("go_collector: unknown runtime metrics group `%s`", group)
+		}
+	}
+
+	for _, expr := range cfg.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("go_collector: invalid include expression `%s`: %w", expr, err)
+		}
+
+		rules = append(rules, collectors.GoRuntimeMetricsRule{Matcher: re})
+	}
+
+	excludes := make([]*regexp.Regexp, 0, len(cfg.Exclude))
+	for _, expr := range cfg.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("go_collector: invalid exclude expression `%s`: %w", expr, err)
+		}
+
+		excludes = append(excludes, re)
+	}
+
+	if cfg.DisableMemStats {
+		return collectors.NewGoCollector(
+			collectors.WithGoCollectorRuntimeMetrics(rules...),
+			collectors.WithoutGoCollectorRuntimeMetrics(excludes...),
+			collectors.WithGoCollectorMemStatsMetricsDisabled(),
+		), nil
+	}
+
+	return collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(rules...),
+		collectors.WithoutGoCollectorRuntimeMetrics(excludes...),
+	), nil
+}
@@ -1,17 +1,298 @@
 package metrics
 
 import (
+	stderr "errors"
 	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 )
 
 // Config configures metrics service.
 type Config struct {
-	// Address to listen
+	// Address to listen on, see Addresses for additional listeners.
 	Address string `mapstructure:"address"`
+	// Addresses are the additional addresses, each served by its own listener. Merged with Address by InitDefaults.
+	Addresses []string `mapstructure:"addresses"`
+	// ListenAttempts is the number of attempts to bind the address while it is still in use, e.g. by the previous process.
+	ListenAttempts int `mapstructure:"listen_attempts"`
+	// ShutdownTimeout bounds the graceful shutdown when the stop context has no deadline.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// MaxHeaderBytes limits the size of the scrape request headers, 1MB by default.
+	MaxHeaderBytes int `mapstructure:"max_header_bytes"`
 	// Collect defines application-specific metrics.
 	Collect map[string]Collector `mapstructure:"collect"`
+	// Groups organize the application-specific metrics of the big configurations, e.g. http, jobs and db, each group
+	// with its own defaults. The collector names are shared with the collect section and should be unique.
+	Groups map[string]Group `mapstructure:"groups"`
+	// SeriesInterval between the counts of the exposed time series (rr_metrics_series_total), disabled when zero.
+	SeriesInterval time.Duration `mapstructure:"series_interval"`
+	// RequireCollectors fails the plugin initialization when the collect section is empty, e.g. a wrong config file.
+	RequireCollectors bool `mapstructure:"require_collectors"`
+	// Labels are global constant labels attached to every exposed metric.
+	Labels map[string]string `mapstructure:"labels"`
+	// StrictLabels rejects the empty and whitespace-only label values in the RPC calls.
+	StrictLabels bool `mapstructure:"strict_labels"`
+	// LogLabels includes the label values in the RPC log lines and errors, true by default. When disabled, only the number
+	// of the label values is reported, so the sensitive values do not leak into the logs.
+	LogLabels *bool `mapstructure:"log_labels"`
+	// RequireLabelMap rejects the positional label values in the Set and Sub of the vector gauges, the values should be
+	// keyed by the label names, so a label order mismatch is an error instead of a wrong series.
+	RequireLabelMap bool `mapstructure:"require_label_map"`
+	// RequireHelp rejects the collectors declared without help.
+	RequireHelp bool `mapstructure:"require_help"`
+	// EnforceUnits rejects the histograms and summaries named against the base unit convention, e.g. latency_ms.
+	EnforceUnits bool `mapstructure:"enforce_units"`
+	// SanitizeNames replaces the characters which are invalid in the metric names (e.g. dots and dashes) with
+	// underscores instead of rejecting the collector. The RPC calls still use the original name.
+	SanitizeNames bool `mapstructure:"sanitize_names"`
+	// ForceNamespace is the namespace of every collector declared via RPC, the empty namespace is replaced with it
+	// and a different one is rejected.
+	ForceNamespace string `mapstructure:"force_namespace"`
+	// AutoDeclare declares the unknown collectors on the first use (counter for Add, histogram for Observe, gauge for Set),
+	// meant for development, as such collectors have no meaningful help.
+	AutoDeclare bool `mapstructure:"auto_declare"`
+	// CardinalityWarningRatio of max_cardinality, crossing it is reported once per collector before the cap bites.
+	CardinalityWarningRatio float64 `mapstructure:"cardinality_warning_ratio"`
+	// Relabel renames or drops the metric families at scrape time.
+	Relabel []Relabel `mapstructure:"relabel"`
+	// TimestampSamples stamps the samples with the gather time.
+	TimestampSamples bool `mapstructure:"timestamp_samples"`
+	// AllowUnsetEnv expands the unset environment variables in the collector definitions to empty strings
+	// instead of failing.
+	AllowUnsetEnv bool `mapstructure:"allow_unset_env"`
+	// EnableOpenMetrics enables the OpenMetrics exposition format when requested by the scraper.
+	// The global labels are exposed as target_info as well.
+	EnableOpenMetrics bool `mapstructure:"enable_openmetrics"`
+	// EnableJSON exposes the metrics as JSON on the JSONPath, for the tools which can't parse the exposition format.
+	EnableJSON bool `mapstructure:"enable_json"`
+	// JSONPath of the JSON endpoint.
+	JSONPath string `mapstructure:"json_path"`
+	// ScrapeCacheTTL shares the gathered metrics between the scrapes for the given duration, disabled when zero.
+	ScrapeCacheTTL time.Duration `mapstructure:"scrape_cache_ttl"`
+	// EnableFederate exposes the metric families matched by the match[] name globs on the FederatePath.
+	EnableFederate bool `mapstructure:"enable_federate"`
+	// FederatePath of the filtered scrape endpoint.
+	FederatePath string `mapstructure:"federate_path"`
+	// EnablePprof exposes the net/http/pprof handlers on /debug/pprof/ of the metrics server.
+	EnablePprof bool `mapstructure:"enable_pprof"`
+	// MaxScrapeRequests limits the number of concurrent scrapes of all endpoints, 503 is returned beyond the limit. Zero means unlimited.
+	MaxScrapeRequests int `mapstructure:"max_scrape_requests"`
+	// ScrapeTimeout of a single gather, 503 is returned when exceeded. Should be lower than the write timeout,
+	// otherwise the server closes the connection before the handler is able to respond. Zero means no timeout.
+	ScrapeTimeout time.Duration `mapstructure:"scrape_timeout"`
+	// Compression of the scrape responses.
+	Compression *Compression `mapstructure:"compression"`
+	// AllowedCIDRs restricts the clients of the metrics endpoint, everyone is allowed when empty.
+	// The client is identified by the address of the direct peer, unless TrustProxy is set.
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+	// TrustProxy identifies the client by the X-Forwarded-For hops appended by the reverse proxies in front of
+	// the metrics endpoint. The header is honoured only for the peers within TrustedProxies.
+	TrustProxy bool `mapstructure:"trust_proxy"`
+	// TrustedProxies are the networks of the reverse proxies, required by TrustProxy.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// LogRequests logs every request to the metrics endpoint, e.g. to find unexpected scrapers.
+	LogRequests bool `mapstructure:"log_requests"`
+	// DebugHeaders adds the X-RR-Metrics-Format header with the negotiated exposition format to the scrape responses.
+	DebugHeaders bool `mapstructure:"debug_headers"`
+	// ServerHeader is the value of the Server response header, the header is not sent when empty.
+	ServerHeader string `mapstructure:"server_header"`
+	// TLS serves the metrics over HTTPS.
+	TLS *TLS `mapstructure:"tls"`
+	// HTTP2 configures the HTTP/2 of the metrics server.
+	HTTP2 *HTTP2 `mapstructure:"http2"`
+	// BasicAuth protects the metrics endpoint with HTTP basic authentication.
+	BasicAuth *BasicAuth `mapstructure:"basic_auth"`
+	// Timeouts of the metrics HTTP server.
+	Timeouts *Timeouts `mapstructure:"timeouts"`
+	// GoCollector customizes the runtime metrics exposed by the default Go collector.
+	GoCollector *GoCollector `mapstructure:"go_collector"`
+	// Pushgateway periodically pushes metrics to the Prometheus Pushgateway.
+	Pushgateway *Pushgateway `mapstructure:"pushgateway"`
+	// RemoteWrite periodically ships metrics to the Prometheus remote-write endpoint.
+	RemoteWrite *RemoteWrite `mapstructure:"remote_write"`
+	// OTLP periodically exports metrics to the OpenTelemetry collector.
+	OTLP *OTLP `mapstructure:"otlp"`
+	// StatsD mirrors the RPC operations to the StatsD endpoint.
+	StatsD *StatsD `mapstructure:"statsd"`
+}
+
+// StatsD configures mirroring the RPC operations to StatsD.
+type StatsD struct {
+	// Address (host:port) of the StatsD UDP endpoint.
+	Address string `mapstructure:"address"`
+	// Prefix prepended to every metric name.
+	Prefix string `mapstructure:"prefix"`
+	// FlushInterval between the batched sends.
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// Tags attached to every metric, only sent in the DogStatsD format.
+	Tags map[string]string `mapstructure:"tags"`
+	// DogStatsD enables the tags derived from the collector labels and the histogram type for the observations.
+	DogStatsD bool `mapstructure:"dogstatsd"`
+}
+
+// OTLP configures exporting metrics using the OpenTelemetry protocol.
+type OTLP struct {
+	// Endpoint (host:port) of the OTLP receiver.
+	Endpoint string `mapstructure:"endpoint"`
+	// Protocol is either grpc or http.
+	Protocol string `mapstructure:"protocol"`
+	// Headers added to every export request.
+	Headers map[string]string `mapstructure:"headers"`
+	// Interval between exports.
+	Interval time.Duration `mapstructure:"interval"`
+	// Insecure disables TLS.
+	Insecure bool `mapstructure:"insecure"`
+}
+
+// RemoteWrite configures shipping metrics using the Prometheus remote-write protocol.
+type RemoteWrite struct {
+	// Endpoint URL of the remote-write receiver.
+	Endpoint string `mapstructure:"endpoint"`
+	// Interval between writes.
+	Interval time.Duration `mapstructure:"interval"`
+	// Timeout of a single write request.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Headers added to every write request.
+	Headers map[string]string `mapstructure:"headers"`
+	// TenantID is sent in the X-Scope-OrgID header.
+	TenantID string `mapstructure:"tenant_id"`
+	// MaxRetries of a failed write, with exponential backoff between attempts.
+	MaxRetries int `mapstructure:"max_retries"`
+}
+
+// GoCollector configures the runtime/metrics exposed by the default Go collector.
+type GoCollector struct {
+	// RuntimeMetrics enables groups of runtime/metrics: all, gc, memory, scheduler, debug.
+	RuntimeMetrics []string `mapstructure:"runtime_metrics"`
+	// Include are regular expressions of additional runtime/metrics names to expose, e.g. ^/sched/latencies:seconds$.
+	Include []string `mapstructure:"include"`
+	// Exclude are regular expressions of runtime/metrics names to hide.
+	Exclude []string `mapstructure:"exclude"`
+	// DisableMemStats disables the legacy memstats-like metrics.
+	DisableMemStats bool `mapstructure:"disable_memstats"`
+}
+
+// Pushgateway configures pushing metrics to the Prometheus Pushgateway.
+type Pushgateway struct {
+	// URL of the Pushgateway.
+	URL string `mapstructure:"url"`
+	// Job name used for the pushed metrics.
+	Job string `mapstructure:"job"`
+	// Grouping labels used for the pushed metrics.
+	Grouping map[string]string `mapstructure:"grouping"`
+	// Interval between pushes.
+	Interval time.Duration `mapstructure:"interval"`
+	// Mode is either push (replace the metrics of the group) or add (merge with them).
+	Mode string `mapstructure:"mode"`
+	// Username for the Pushgateway basic auth.
+	Username string `mapstructure:"username"`
+	// Password for the Pushgateway basic auth.
+	Password string `mapstructure:"password"`
+}
+
+// TLS of the metrics server.
+type TLS struct {
+	// Cert is the path to the PEM encoded certificate (chain).
+	Cert string `mapstructure:"cert"`
+	// Key is the path to the PEM encoded private key.
+	Key string `mapstructure:"key"`
+	// MinVersion is either 1.2 (default) or 1.3.
+	MinVersion string `mapstructure:"min_version"`
+	// CipherSuites is the allowlist of the TLS 1.2 cipher suites by name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// The suites preferred for the current hardware are used when empty.
+	CipherSuites []string `mapstructure:"cipher_suites"`
+}
+
+// HTTP2 configures the HTTP/2 of the metrics server. HTTP/2 over TLS is negotiated via ALPN, h2c is opt-in.
+type HTTP2 struct {
+	// H2C enables the cleartext HTTP/2, there is no TLS to protect the connection, so it is for trusted networks only.
+	H2C bool `mapstructure:"h2c"`
+	// MaxConcurrentStreams per connection, 250 by default.
+	MaxConcurrentStreams uint32 `mapstructure:"max_concurrent_streams"`
+}
+
+// Timeouts configures the metrics HTTP server timeouts.
+type Timeouts struct {
+	// Read is the maximum duration for reading the entire request.
+	Read time.Duration `mapstructure:"read"`
+	// Write is the maximum duration before timing out writes of the response.
+	Write time.Duration `mapstructure:"write"`
+	// Idle is the maximum amount of time to wait for the next request when keep-alives are enabled.
+	Idle time.Duration `mapstructure:"idle"`
+	// ReadHeader is the amount of time allowed to read request headers.
+	ReadHeader time.Duration `mapstructure:"read_header"`
+}
+
+// Compression configures the compression of the scrape responses negotiated via the Accept-Encoding header.
+type Compression struct {
+	// Disable turns the compression off.
+	Disable bool `mapstructure:"disable"`
+	// Encodings offered to the scrapers (gzip, zstd), all supported encodings are offered when empty.
+	Encodings []string `mapstructure:"encodings"`
+}
+
+// BasicAuth configures HTTP basic authentication for the metrics endpoint.
+type BasicAuth struct {
+	// Username expected in the Authorization header.
+	Username string `mapstructure:"username"`
+	// Password in plain text.
+	Password string `mapstructure:"password"`
+	// PasswordHash is a bcrypt hash of the password, used instead of Password.
+	PasswordHash string `mapstructure:"password_hash"`
+}
+
+// ConstSample is a fixed sample of the const collector.
+type ConstSample struct {
+	// Labels of the sample keyed by the label names, all declared labels are required.
+	Labels map[string]string `json:"labels,omitempty" mapstructure:"labels"`
+	// Value of the sample.
+	Value float64 `json:"value" mapstructure:"value"`
+}
+
+// HistogramMirror is the histogram registered alongside the summary, every observation is written to both.
+type HistogramMirror struct {
+	// Buckets of the histogram, the default buckets when empty.
+	Buckets []float64 `json:"buckets,omitempty" mapstructure:"buckets"`
+	// Suffix appended to the summary name, `_histogram` by default.
+	Suffix string `json:"suffix,omitempty" mapstructure:"suffix"`
+}
+
+// suffix returns the Suffix, `_histogram` when unset.
+func (h *HistogramMirror) suffix() string {
+	if h.Suffix == "" {
+		return "_histogram"
+	}
+
+	return h.Suffix
+}
+
+// Group is a named set of collectors sharing the defaults. The namespace and the subsystem of the group are used by
+// the collectors which do not set their own, the const labels are merged with the collector ones (which take precedence).
+type Group struct {
+	// Namespace of the group collectors.
+	Namespace string `json:"namespace,omitempty" mapstructure:"namespace"`
+	// Subsystem of the group collectors.
+	Subsystem string `json:"subsystem,omitempty" mapstructure:"subsystem"`
+	// ConstLabels attached to every series of the group collectors.
+	ConstLabels map[string]string `json:"const_labels,omitempty" mapstructure:"const_labels"`
+	// Collect defines the collectors of the group.
+	Collect map[string]Collector `json:"collect,omitempty" mapstructure:"collect"`
+}
+
+// Enum is the state label of the gauge, SetEnum sets the series of the active state and zeroes the other states.
+type Enum struct {
+	// Label is the name of the state label, one of the collector labels.
+	Label string `json:"label" mapstructure:"label"`
+	// States are all values of the state label, e.g. closed, open and half_open.
+	States []string `json:"states" mapstructure:"states"`
 }
 
 type NamedCollector struct {
@@ -19,6 +300,32 @@ type NamedCollector struct {
 	Name string `json:"name"`
 	// Collector structure
 	Collector `json:"collector"`
+	// Owner identifies the declaring worker, so its collectors can be removed with UnregisterByOwner. Optional.
+	Owner string `json:"owner,omitempty"`
+}
+
+// BucketsType represents the prometheus bucket helpers
+type BucketsType string
+
+const (
+	// LinearBuckets are Count buckets Width apart, starting at Start
+	LinearBuckets BucketsType = "linear"
+	// ExponentialBuckets are Count buckets, each Factor times the previous one, starting at Start
+	ExponentialBuckets BucketsType = "exponential"
+)
+
+// BucketsGenerator describes the histogram buckets generated by the prometheus bucket helpers.
+type BucketsGenerator struct {
+	// Type of the helper (linear, exponential).
+	Type BucketsType `json:"type"`
+	// Start is the upper bound of the first bucket.
+	Start float64 `json:"start"`
+	// Width between the linear buckets.
+	Width float64 `json:"width,omitempty"`
+	// Factor between the exponential buckets.
+	Factor float64 `json:"factor,omitempty"`
+	// Count of the generated buckets.
+	Count int `json:"count"`
 }
 
 // CollectorType represents prometheus collector types
@@ -33,6 +340,10 @@ const (
 	Counter CollectorType = "counter"
 	// Summary type
 	Summary CollectorType = "summary"
+	// GaugeFunc type, the value is cached by the plugin and collected at scrape time
+	GaugeFunc CollectorType = "gauge_func"
+	// Info type, a gauge fixed at 1 with a single (replaceable) label set, e.g. version and commit
+	Info CollectorType = "info"
 )
 
 // Collector describes a single application specific metric.
@@ -41,98 +352,647 @@ type Collector struct {
 	Namespace string `json:"namespace,omitempty"`
 	// Subsystem of the metric.
 	Subsystem string `json:"subsystem,omitempty"`
-	// Collector type (histogram, gauge, counter, summary).
+	// Collector type (histogram, gauge, counter, summary, gauge_func, info).
 	Type CollectorType `json:"type"`
 	// Help of collector.
 	Help string `json:"help"`
 	// Labels for vectorized metrics.
 	Labels []string `json:"labels"`
+	// Info is the initial label set of the info collector, keyed by the label names.
+	Info map[string]string `json:"info,omitempty" mapstructure:"info"`
+	// ConstLabels are fixed labels attached to every series of the collector.
+	ConstLabels map[string]string `json:"const_labels,omitempty" mapstructure:"const_labels"`
 	// Buckets for histogram metric.
 	Buckets []float64 `json:"buckets"`
+	// BucketsGenerator generates the histogram buckets, appended to the explicit Buckets.
+	BucketsGenerator *BucketsGenerator `json:"buckets_generator,omitempty" mapstructure:"buckets_generator"`
 	// Objectives for the summary opts
 	Objectives map[float64]float64 `json:"objectives,omitempty"`
+	// MaxAge defines the duration for which an observation stays relevant for the summary.
+	MaxAge time.Duration `json:"max_age,omitempty" mapstructure:"max_age"`
+	// AgeBuckets is the number of buckets used to exclude observations older than MaxAge from the summary.
+	AgeBuckets uint32 `json:"age_buckets,omitempty" mapstructure:"age_buckets"`
+	// BufCap defines the default sample stream buffer size of the summary.
+	BufCap uint32 `json:"buf_cap,omitempty" mapstructure:"buf_cap"`
+	// Const are the immutable samples of the gauge or counter, known at startup. The collector can't be updated via RPC.
+	Const []ConstSample `json:"const,omitempty" mapstructure:"const"`
+	// MirrorAsHistogram exposes the summary as a histogram as well, for the migration from the summaries.
+	MirrorAsHistogram *HistogramMirror `json:"mirror_as_histogram,omitempty" mapstructure:"mirror_as_histogram"`
+	// NativeHistogramBucketFactor enables native (sparse) histogram buckets when greater than one. Along with Buckets
+	// the histogram exposes both the classic and the native buckets, e.g. for the migration.
+	NativeHistogramBucketFactor float64 `json:"native_histogram_bucket_factor,omitempty" mapstructure:"native_histogram_bucket_factor"`
+	// NativeHistogramMaxBucketNumber limits the number of native histogram buckets.
+	NativeHistogramMaxBucketNumber uint32 `json:"native_histogram_max_bucket_number,omitempty" mapstructure:"native_histogram_max_bucket_number"`
+	// NativeHistogramMinResetDuration is the minimal duration between native histogram resets.
+	NativeHistogramMinResetDuration time.Duration `json:"native_histogram_min_reset_duration,omitempty" mapstructure:"native_histogram_min_reset_duration"`
+	// TTL deletes the series of a vector collector which were not updated for the given duration.
+	TTL time.Duration `json:"ttl,omitempty" mapstructure:"ttl"`
+	// SweepInterval between the checks for the expired series, TTL/2 by default.
+	SweepInterval time.Duration `json:"sweep_interval,omitempty" mapstructure:"sweep_interval"`
+	// MaxCardinality limits the number of distinct series of a vector collector, new series beyond it are rejected.
+	// Zero means unlimited.
+	MaxCardinality int `json:"max_cardinality,omitempty" mapstructure:"max_cardinality"`
+	// InitialValue of the gauge or counter, applied as soon as the collector is created. For the vector collectors
+	// it is applied to the InitialLabels series.
+	InitialValue float64 `json:"initial_value,omitempty" mapstructure:"initial_value"`
+	// InitialLabels are the label values of the series created along with the vector gauge or counter.
+	InitialLabels [][]string `json:"initial_labels,omitempty" mapstructure:"initial_labels"`
+	// Enum marks one of the labels of the vector gauge as the state label, e.g. of a circuit breaker, set by SetEnum.
+	Enum *Enum `json:"enum,omitempty" mapstructure:"enum"`
 }
 
 // register application specific metrics.
 func (c *Config) getCollectors() (map[string]*collector, error) {
-	if c.Collect == nil {
+	if c.Collect == nil && c.Groups == nil {
 		return nil, nil
 	}
 
+	defs, err := c.definitions()
+	if err != nil {
+		return nil, err
+	}
+
 	collectors := make(map[string]*collector)
 
-	for name, m := range c.Collect {
-		var promCol prometheus.Collector
-		switch m.Type {
-		case Histogram:
-			opts := prometheus.HistogramOpts{
-				Name:      name,
-				Namespace: m.Namespace,
-				Subsystem: m.Subsystem,
-				Help:      m.Help,
-				Buckets:   m.Buckets,
+	for name, m := range defs {
+		err := expandEnv(name, &m, c.AllowUnsetEnv)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.checkHelp(name, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.checkUnits(name, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		promCol, err := newCollector(c.sanitizeNames(name, &m), &m)
+		if err != nil {
+			return nil, err
+		}
+
+		col := wrapCollector(promCol, &m, false)
+		col.redactLabels = !c.logLabels()
+		col.fromConfig = true
+		collectors[name] = col
+	}
+
+	return collectors, nil
+}
+
+// Validate checks the whole configuration, including the collector definitions, without starting the server or
+// registering anything. It applies the defaults and returns all found errors joined.
+func (c *Config) Validate() error {
+	c.InitDefaults()
+
+	var errs []error
+	err := c.validate()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	defs, err := c.definitions()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+
+	// sort to get a stable error message
+	slices.Sort(names)
+	for _, name := range names {
+		m := defs[name]
+		err = expandEnv(name, &m, c.AllowUnsetEnv)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		err = c.checkHelp(name, &m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		err = c.checkUnits(name, &m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		err = validateCollector(c.sanitizeNames(name, &m), &m)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return stderr.Join(errs...)
+}
+
+// definitions returns the collectors of the collect section along with the collectors of the groups, the group
+// defaults applied.
+func (c *Config) definitions() (map[string]Collector, error) {
+	defs := make(map[string]Collector, len(c.Collect))
+	maps.Copy(defs, c.Collect)
+
+	groups := slices.Sorted(maps.Keys(c.Groups))
+	for _, group := range groups {
+		g := c.Groups[group]
+		for name, m := range g.Collect {
+			if _, ok := defs[name]; ok {
+				return nil, fmt.Errorf("groups.%s: collector `%s` is already defined", group, name)
 			}
 
-			if len(m.Labels) != 0 {
-				promCol = prometheus.NewHistogramVec(opts, m.Labels)
-			} else {
-				promCol = prometheus.NewHistogram(opts)
+			if m.Namespace == "" {
+				m.Namespace = g.Namespace
 			}
-		case Gauge:
-			opts := prometheus.GaugeOpts{
-				Name:      name,
-				Namespace: m.Namespace,
-				Subsystem: m.Subsystem,
-				Help:      m.Help,
+
+			if m.Subsystem == "" {
+				m.Subsystem = g.Subsystem
 			}
 
-			if len(m.Labels) != 0 {
-				promCol = prometheus.NewGaugeVec(opts, m.Labels)
-			} else {
-				promCol = prometheus.NewGauge(opts)
+			if len(g.ConstLabels) > 0 {
+				// the definitions are copied by value, the maps are not, so the collector labels are not modified
+				labels := maps.Clone(g.ConstLabels)
+				maps.Copy(labels, m.ConstLabels)
+				m.ConstLabels = labels
 			}
-		case Counter:
-			opts := prometheus.CounterOpts{
-				Name:      name,
-				Namespace: m.Namespace,
-				Subsystem: m.Subsystem,
-				Help:      m.Help,
+
+			defs[name] = m
+		}
+	}
+
+	return defs, nil
+}
+
+// collectorsCount is the number of the collectors in the collect section and the groups.
+func (c *Config) collectorsCount() int {
+	n := len(c.Collect)
+	for _, g := range c.Groups {
+		n += len(g.Collect)
+	}
+
+	return n
+}
+
+// validatePaths checks that the endpoints do not collide, they share the mux which panics on a duplicate path.
+func (c *Config) validatePaths() error {
+	taken := map[string]string{"/metrics/{registry}": "the named registries"}
+	if c.EnablePprof {
+		for path := range pprofHandlers {
+			taken[path] = "enable_pprof"
+		}
+	}
+
+	for _, p := range []struct {
+		option, path string
+		enabled      bool
+	}{
+		{"json_path", c.JSONPath, c.EnableJSON},
+		{"federate_path", c.FederatePath, c.EnableFederate},
+	} {
+		if !p.enabled {
+			continue
+		}
+
+		// the mux treats the braces as wildcards and the whitespace as the method separator
+		if strings.ContainsAny(p.path, "{} \t") {
+			return fmt.Errorf("%s should be a plain path, got `%s`", p.option, p.path)
+		}
+
+		if owner, ok := taken[p.path]; ok {
+			return fmt.Errorf("%s `%s` is already served by %s", p.option, p.path, owner)
+		}
+		taken[p.path] = p.option
+	}
+
+	return nil
+}
+
+// trustedProxies parses the trusted_proxies, nil unless trust_proxy is set.
+func (c *Config) trustedProxies() ([]*net.IPNet, error) {
+	if !c.TrustProxy {
+		return nil, nil
+	}
+
+	return parseCIDRs("trusted_proxies", c.TrustedProxies)
+}
+
+// logLabels reports whether the label values may be logged, unset means true.
+func (c *Config) logLabels() bool {
+	return c.LogLabels == nil || *c.LogLabels
+}
+
+// sanitizeNames rewrites the metric name, namespace and subsystem of the collector with sanitize_names.
+// Returns the name the collector is registered with.
+func (c *Config) sanitizeNames(name string, m *Collector) string {
+	if !c.SanitizeNames {
+		return name
+	}
+
+	m.Namespace = sanitizeMetricName(m.Namespace)
+	m.Subsystem = sanitizeMetricName(m.Subsystem)
+	return sanitizeMetricName(name)
+}
+
+// forceNamespace applies force_namespace to the collector declared via RPC, a different namespace is rejected.
+func (c *Config) forceNamespace(name string, m *Collector) error {
+	if c.ForceNamespace == "" {
+		return nil
+	}
+
+	switch m.Namespace {
+	case "":
+		m.Namespace = c.ForceNamespace
+	case c.ForceNamespace:
+	default:
+		return fmt.Errorf("collector `%s` has namespace `%s`, only `%s` is allowed by force_namespace", name, m.Namespace, c.ForceNamespace)
+	}
+
+	return nil
+}
+
+// checkHelp rejects the collectors without help when require_help is enabled.
+func (c *Config) checkHelp(name string, m *Collector) error {
+	if c.RequireHelp && strings.TrimSpace(m.Help) == "" {
+		return fmt.Errorf("collector `%s` has no help, required by require_help", name)
+	}
+
+	return nil
+}
+
+// nonBaseUnits are the name suffixes of the units which should be converted to the base ones, mapped to the base unit.
+var nonBaseUnits = map[string]string{
+	"ns": "seconds", "nanos": "seconds", "nanoseconds": "seconds",
+	"us": "seconds", "micros": "seconds", "microseconds": "seconds",
+	"ms": "seconds", "millis": "seconds", "milliseconds": "seconds",
+	"minutes": "seconds", "hours": "seconds", "days": "seconds",
+	"bits": "bytes", "kb": "bytes", "kib": "bytes", "kilobytes": "bytes",
+	"mb": "bytes", "mib": "bytes", "megabytes": "bytes", "gb": "bytes", "gib": "bytes", "gigabytes": "bytes",
+}
+
+// durationWords mark the names of the histograms and summaries which measure durations.
+var durationWords = []string{"duration", "latency", "time", "elapsed"}
+
+// checkUnits rejects the histograms and summaries which do not follow the base unit naming convention when
+// enforce_units is enabled: the durations are in seconds and end with _seconds, the sizes end with _bytes. It is
+// a heuristic on the name, so it catches the common mistakes only, e.g. latency_ms or request_duration.
+func (c *Config) checkUnits(name string, m *Collector) error {
+	if !c.EnforceUnits || (m.Type != Histogram && m.Type != Summary) {
+		return nil
+	}
+
+	words := strings.Split(strings.ToLower(name), "_")
+	last := words[len(words)-1]
+	base := strings.Join(words[:len(words)-1], "_")
+
+	if unit, ok := nonBaseUnits[last]; ok && base != "" {
+		return fmt.Errorf("collector `%s` is in `%s`, observe the values in %s and name it `%s_%s` (enforce_units)", name, last, unit, base, unit)
+	}
+
+	if last != "seconds" && slices.ContainsFunc(durationWords, func(w string) bool { return slices.Contains(words, w) }) {
+		return fmt.Errorf("collector `%s` looks like a duration, observe the values in seconds and name it `%s_seconds` (enforce_units)", name, name)
+	}
+
+	if last != "bytes" && slices.Contains(words, "bytes") {
+		return fmt.Errorf("collector `%s` looks like a size, the unit should be the suffix, e.g. `%s_bytes` (enforce_units)",
+			name, strings.Join(slices.DeleteFunc(words, func(w string) bool { return w == "bytes" }), "_"))
+	}
+
+	return nil
+}
+
+// expandEnv expands the ${VAR} and $VAR placeholders in the namespace, subsystem, help and const label values
+// of the collector, so one configuration serves every environment. An unset variable is an error unless allowUnset.
+func expandEnv(name string, m *Collector, allowUnset bool) error {
+	var unset []string
+	expand := func(s string) string {
+		return os.Expand(s, func(key string) string {
+			v, ok := os.LookupEnv(key)
+			if !ok && !slices.Contains(unset, key) {
+				unset = append(unset, key)
 			}
 
-			if len(m.Labels) != 0 {
-				promCol = prometheus.NewCounterVec(opts, m.Labels)
-			} else {
-				promCol = prometheus.NewCounter(opts)
+			return v
+		})
+	}
+
+	m.Namespace = expand(m.Namespace)
+	m.Subsystem = expand(m.Subsystem)
+	m.Help = expand(m.Help)
+
+	if len(m.ConstLabels) > 0 {
+		// the map is shared with the configuration, expand into a copy
+		labels := make(map[string]string, len(m.ConstLabels))
+		for k, v := range m.ConstLabels {
+			labels[k] = expand(v)
+		}
+		m.ConstLabels = labels
+	}
+
+	if len(unset) > 0 && !allowUnset {
+		slices.Sort(unset)
+		return fmt.Errorf("collector `%s` refers to unset environment variables: %s", name, strings.Join(unset, ", "))
+	}
+
+	return nil
+}
+
+// listenAddresses returns Address followed by the Addresses, the Address listed in both is served once.
+func (c *Config) listenAddresses() []string {
+	if c.Address == "" || slices.Contains(c.Addresses, c.Address) {
+		return c.Addresses
+	}
+
+	return append([]string{c.Address}, c.Addresses...)
+}
+
+// validate checks the plugin-level options.
+func (c *Config) validate() error {
+	addrs := c.listenAddresses()
+	for i, addr := range addrs {
+		if addr == "" {
+			return fmt.Errorf("address: empty address")
+		}
+
+		if slices.Contains(addrs[:i], addr) {
+			return fmt.Errorf("address: duplicate address %s", addr)
+		}
+
+		if path, ok := unixSocketPath(addr); ok {
+			if path == "" {
+				return fmt.Errorf("address: empty unix socket path")
 			}
-		case Summary:
-			opts := prometheus.SummaryOpts{
-				Name:       name,
-				Namespace:  m.Namespace,
-				Subsystem:  m.Subsystem,
-				Help:       m.Help,
-				Objectives: m.Objectives,
+
+			fi, err := os.Stat(filepath.Dir(path))
+			if err != nil || !fi.IsDir() {
+				return fmt.Errorf("address: parent directory of the unix socket %s does not exist", path)
 			}
 
-			if len(m.Labels) != 0 {
-				promCol = prometheus.NewSummaryVec(opts, m.Labels)
-			} else {
-				promCol = prometheus.NewSummary(opts)
+			continue
+		}
+
+		err := validateTCPAddress(addr)
+		if err != nil {
+			return fmt.Errorf("address: %w", err)
+		}
+	}
+
+	if c.RequireCollectors && c.collectorsCount() == 0 {
+		return fmt.Errorf("collect section and groups are empty, but require_collectors is set")
+	}
+
+	for name := range c.Labels {
+		err := validateLabelName(name)
+		if err != nil {
+			return fmt.Errorf("labels: %w", err)
+		}
+	}
+
+	if c.EnableJSON && (!strings.HasPrefix(c.JSONPath, "/") || c.JSONPath == "/") {
+		return fmt.Errorf("json_path should be an absolute path other than /, got `%s`", c.JSONPath)
+	}
+
+	if c.EnableFederate && (!strings.HasPrefix(c.FederatePath, "/") || c.FederatePath == "/") {
+		return fmt.Errorf("federate_path should be an absolute path other than /, got `%s`", c.FederatePath)
+	}
+
+	if err := c.validatePaths(); err != nil {
+		return err
+	}
+
+	if c.ListenAttempts < 0 {
+		return fmt.Errorf("listen_attempts should not be negative")
+	}
+
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max_header_bytes should not be negative")
+	}
+
+	if c.SeriesInterval < 0 {
+		return fmt.Errorf("series_interval should not be negative")
+	}
+
+	if c.ScrapeCacheTTL < 0 {
+		return fmt.Errorf("scrape_cache_ttl should not be negative")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout should not be negative")
+	}
+
+	if err := validateRelabel(c.Relabel); err != nil {
+		return err
+	}
+
+	if c.ForceNamespace != "" && !model.IsValidLegacyMetricName(c.ForceNamespace) {
+		return fmt.Errorf("invalid force_namespace `%s`, should match %s", c.ForceNamespace, model.MetricNameRE)
+	}
+
+	if _, err := parseCIDRs("allowed_cidrs", c.AllowedCIDRs); err != nil {
+		return err
+	}
+
+	if _, err := parseCIDRs("trusted_proxies", c.TrustedProxies); err != nil {
+		return err
+	}
+
+	if c.TrustProxy && len(c.TrustedProxies) == 0 {
+		return fmt.Errorf("trust_proxy requires trusted_proxies, otherwise any client could spoof its address")
+	}
+
+	if strings.ContainsAny(c.ServerHeader, "\r\n") {
+		return fmt.Errorf("server_header should not contain line breaks")
+	}
+
+	if c.CardinalityWarningRatio < 0 || c.CardinalityWarningRatio > 1 {
+		return fmt.Errorf("cardinality_warning_ratio should be between 0 and 1, got %v", c.CardinalityWarningRatio)
+	}
+
+	if c.BasicAuth != nil {
+		if c.BasicAuth.Username == "" {
+			return fmt.Errorf("basic_auth: username should not be empty")
+		}
+
+		if c.BasicAuth.Password == "" && c.BasicAuth.PasswordHash == "" {
+			return fmt.Errorf("basic_auth: either password or password_hash should be set")
+		}
+
+		if c.BasicAuth.Password != "" && c.BasicAuth.PasswordHash != "" {
+			return fmt.Errorf("basic_auth: password and password_hash are mutually exclusive")
+		}
+	}
+
+	if c.MaxScrapeRequests < 0 || c.ScrapeTimeout < 0 {
+		return fmt.Errorf("max_scrape_requests and scrape_timeout should not be negative")
+	}
+
+	if c.Compression != nil {
+		for _, enc := range c.Compression.Encodings {
+			if enc != string(promhttp.Gzip) && enc != string(promhttp.Zstd) {
+				return fmt.Errorf("compression: unsupported encoding `%s`, should be either `%s` or `%s`", enc, promhttp.Gzip, promhttp.Zstd)
 			}
-		default:
-			return nil, fmt.Errorf("invalid metric type `%s` for `%s`", m.Type, name)
+		}
+	}
+
+	if pg := c.Pushgateway; pg != nil {
+		if pg.URL == "" || pg.Job == "" {
+			return fmt.Errorf("pushgateway: url and job should not be empty")
 		}
 
-		collectors[name] = &collector{
-			col:        promCol,
-			registered: false,
+		if pg.Interval < 0 {
+			return fmt.Errorf("pushgateway: interval should not be negative")
+		}
+
+		if pg.Mode != PushModePush && pg.Mode != PushModeAdd {
+			return fmt.Errorf("pushgateway: unknown mode `%s`, should be either `%s` or `%s`", pg.Mode, PushModePush, PushModeAdd)
 		}
 	}
 
-	return collectors, nil
+	if rw := c.RemoteWrite; rw != nil {
+		if rw.Endpoint == "" {
+			return fmt.Errorf("remote_write: endpoint should not be empty")
+		}
+
+		if rw.Interval < 0 || rw.Timeout < 0 || rw.MaxRetries < 0 {
+			return fmt.Errorf("remote_write: interval, timeout and max_retries should not be negative")
+		}
+	}
+
+	if sd := c.StatsD; sd != nil {
+		if sd.Address == "" {
+			return fmt.Errorf("statsd: address should not be empty")
+		}
+
+		if sd.FlushInterval < 0 {
+			return fmt.Errorf("statsd: flush_interval should not be negative")
+		}
+	}
+
+	if o := c.OTLP; o != nil {
+		if o.Endpoint == "" {
+			return fmt.Errorf("otlp: endpoint should not be empty")
+		}
+
+		if o.Protocol != OTLPProtocolGRPC && o.Protocol != OTLPProtocolHTTP {
+			return fmt.Errorf("otlp: unknown protocol `%s`, should be grpc or http", o.Protocol)
+		}
+
+		if o.Interval < 0 {
+			return fmt.Errorf("otlp: interval should not be negative")
+		}
+	}
+
+	if c.TLS != nil {
+		err := c.TLS.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if t := c.Timeouts; t != nil && (t.Read < 0 || t.Write < 0 || t.Idle < 0 || t.ReadHeader < 0) {
+		return fmt.Errorf("timeouts: durations should not be negative")
+	}
+
+	return nil
 }
 
 func (c *Config) InitDefaults() {
-	if c.Address == "" {
+	if c.Address == "" && len(c.Addresses) == 0 {
 		c.Address = "127.0.0.1:2112"
 	}
+	c.Addresses = c.listenAddresses()
+
+	if c.JSONPath == "" {
+		c.JSONPath = "/metrics.json"
+	}
+
+	if c.FederatePath == "" {
+		c.FederatePath = "/federate"
+	}
+
+	if c.ListenAttempts == 0 {
+		c.ListenAttempts = 3
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = time.Second * 10
+	}
+
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = maxHeaderSize
+	}
+
+	if c.CardinalityWarningRatio == 0 {
+		c.CardinalityWarningRatio = 0.8
+	}
+
+	if c.Pushgateway != nil {
+		if c.Pushgateway.Interval == 0 {
+			c.Pushgateway.Interval = time.Second * 15
+		}
+
+		if c.Pushgateway.Mode == "" {
+			c.Pushgateway.Mode = PushModePush
+		}
+	}
+
+	if c.RemoteWrite != nil {
+		if c.RemoteWrite.Interval == 0 {
+			c.RemoteWrite.Interval = time.Second * 30
+		}
+
+		if c.RemoteWrite.Timeout == 0 {
+			c.RemoteWrite.Timeout = time.Second * 10
+		}
+
+		if c.RemoteWrite.MaxRetries == 0 {
+			c.RemoteWrite.MaxRetries = 3
+		}
+	}
+
+	if c.StatsD != nil && c.StatsD.FlushInterval == 0 {
+		c.StatsD.FlushInterval = time.Second
+	}
+
+	if c.OTLP != nil {
+		if c.OTLP.Protocol == "" {
+			c.OTLP.Protocol = OTLPProtocolGRPC
+		}
+
+		if c.OTLP.Interval == 0 {
+			c.OTLP.Interval = time.Second * 30
+		}
+	}
+
+	if c.TLS != nil && c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = TLSVersion12
+	}
+
+	if c.Timeouts == nil {
+		c.Timeouts = &Timeouts{}
+	}
+
+	if c.Timeouts.Read == 0 {
+		c.Timeouts.Read = time.Minute * 2
+	}
+
+	if c.Timeouts.Write == 0 {
+		c.Timeouts.Write = time.Minute * 2
+	}
+
+	if c.Timeouts.Idle == 0 {
+		c.Timeouts.Idle = time.Hour
+	}
+
+	if c.Timeouts.ReadHeader == 0 {
+		c.Timeouts.ReadHeader = time.Minute * 2
+	}
 }
@@ -2,11 +2,18 @@ package metrics
 
 import (
 	"bytes"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/goccy/go-json"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_Config_Hydrate_Error1(t *testing.T) {
@@ -85,3 +92,552 @@ func Test_Config_MetricsVector(t *testing.T) {
 	assert.IsType(t, prometheus.NewSummaryVec(prometheus.SummaryOpts{}, []string{}), m["metric3"].col)
 	assert.IsType(t, prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{}), m["metric4"].col)
 }
+
+func Test_Config_Timeouts(t *testing.T) {
+	c := &Config{}
+	c.InitDefaults()
+
+	assert.NoError(t, c.validate())
+	assert.Equal(t, time.Minute*2, c.Timeouts.Read)
+	assert.Equal(t, time.Minute*2, c.Timeouts.Write)
+	assert.Equal(t, time.Hour, c.Timeouts.Idle)
+	assert.Equal(t, time.Minute*2, c.Timeouts.ReadHeader)
+
+	c = &Config{Timeouts: &Timeouts{Write: -time.Second}}
+	c.InitDefaults()
+	assert.Error(t, c.validate())
+}
+
+func Test_Config_NativeHistogram(t *testing.T) {
+	c := &Config{
+		Collect: map[string]Collector{
+			"native": {Type: Histogram, NativeHistogramBucketFactor: 1.1, NativeHistogramMaxBucketNumber: 100},
+		},
+	}
+
+	m, err := c.getCollectors()
+	assert.NoError(t, err)
+	assert.IsType(t, prometheus.NewHistogram(prometheus.HistogramOpts{}), m["native"].col)
+
+	c.Collect["native"] = Collector{Type: Histogram, NativeHistogramBucketFactor: 0.5}
+	_, err = c.getCollectors()
+	assert.Error(t, err)
+
+	c.Collect["native"] = Collector{Type: Histogram, NativeHistogramMaxBucketNumber: 100}
+	_, err = c.getCollectors()
+	assert.Error(t, err)
+}
+
+func Test_Config_Hydrate(t *testing.T) {
+	want := &Config{
+		Address: "127.0.0.1:2112",
+		Labels:  map[string]string{"app": "testapp", "env": "testenv"},
+	}
+
+	cfg := `{"address":"127.0.0.1:2112","labels":{"app":"testapp","env":"testenv"}}`
+	c := &Config{}
+	err := json.Unmarshal([]byte(cfg), &c)
+	assert.NoError(t, err)
+	assert.Equal(t, want, c)
+
+	// viper decodes the configuration with the weakly typed input
+	c = &Config{}
+	err = mapstructure.WeakDecode(map[string]any{
+		"address": "127.0.0.1:2112",
+		"labels":  map[string]any{"app": "testapp", "env": "testenv"},
+	}, c)
+	assert.NoError(t, err)
+	assert.Equal(t, want, c)
+	assert.NoError(t, c.validate())
+
+	c = &Config{}
+	err = json.Unmarshal([]byte(`{"address":"127.0.0.1:2112","addresses":["127.0.0.1:2112","127.0.0.1:2113"]}`), &c)
+	assert.NoError(t, err)
+	assert.NoError(t, c.validate())
+	c.InitDefaults()
+	assert.Equal(t, []string{"127.0.0.1:2112", "127.0.0.1:2113"}, c.Addresses)
+
+	c = &Config{}
+	err = mapstructure.WeakDecode(map[string]any{"address": "127.0.0.1:2113", "addresses": []any{"127.0.0.1:2112", "127.0.0.1:2112"}}, c)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, c.validate(), "duplicate")
+
+	c = &Config{Addresses: []string{"127.0.0.1:2113"}}
+	c.InitDefaults()
+	assert.Empty(t, c.Address)
+	assert.Equal(t, []string{"127.0.0.1:2113"}, c.Addresses)
+}
+
+func Test_Config_DefaultBuckets(t *testing.T) {
+	c := &Config{Collect: map[string]Collector{
+		"latency":  {Type: Histogram},
+		"duration": {Type: Histogram, Labels: []string{"method"}},
+	}}
+
+	m, err := c.getCollectors()
+	require.NoError(t, err)
+
+	m["duration"].col.(*prometheus.HistogramVec).WithLabelValues("GET").Observe(1)
+	for name, col := range m {
+		reg := prometheus.NewRegistry()
+		require.NoError(t, reg.Register(col.col))
+
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		require.Len(t, families, 1, name)
+
+		var bounds []float64
+		for _, b := range families[0].GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+		}
+		assert.Equal(t, prometheus.DefBuckets, bounds, name)
+	}
+}
+
+func Test_Config_BucketsGenerator(t *testing.T) {
+	tests := []struct {
+		name      string
+		buckets   []float64
+		generator *BucketsGenerator
+		want      []float64
+		wantErr   bool
+	}{
+		{"linear", nil, &BucketsGenerator{Type: LinearBuckets, Start: 1, Width: 2, Count: 3}, []float64{1, 3, 5}, false},
+		{"exponential", nil, &BucketsGenerator{Type: ExponentialBuckets, Start: 1, Factor: 10, Count: 3}, []float64{1, 10, 100}, false},
+		{"merged", []float64{0.5, 3}, &BucketsGenerator{Type: LinearBuckets, Start: 1, Width: 2, Count: 3}, []float64{0.5, 1, 3, 5}, false},
+		{"zero count", nil, &BucketsGenerator{Type: LinearBuckets, Start: 1, Width: 2}, nil, true},
+		{"zero width", nil, &BucketsGenerator{Type: LinearBuckets, Start: 1, Count: 3}, nil, true},
+		{"small factor", nil, &BucketsGenerator{Type: ExponentialBuckets, Start: 1, Factor: 1, Count: 3}, nil, true},
+		{"unknown", nil, &BucketsGenerator{Type: "log", Count: 3}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.generator.append(test.buckets)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func Test_Config_GoCollector(t *testing.T) {
+	col, err := newGoCollector(&GoCollector{RuntimeMetrics: []string{"scheduler"}, Include: []string{"^/gc/.*"}})
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(col))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	assert.Contains(t, names, "go_sched_latencies_seconds")
+
+	_, err = newGoCollector(&GoCollector{RuntimeMetrics: []string{"unknown"}})
+	assert.Error(t, err)
+
+	_, err = newGoCollector(&GoCollector{Exclude: []string{"("}})
+	assert.Error(t, err)
+}
+
+func Test_Config_Buckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets []float64
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"increasing", []float64{0.1, 0.5, 1}, false},
+		{"unsorted", []float64{0.5, 0.1}, true},
+		{"duplicate", []float64{0.1, 0.1}, true},
+		{"inf", []float64{0.1, math.Inf(1)}, true},
+		{"nan", []float64{math.NaN()}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Collect: map[string]Collector{"latency": {Type: Histogram, Buckets: test.buckets}}}
+			_, err := c.getCollectors()
+			if test.wantErr {
+				assert.ErrorContains(t, err, "latency")
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_Config_Objectives(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectives map[float64]float64
+		wantErr    bool
+	}{
+		{"empty", nil, false},
+		{"valid", map[float64]float64{0.5: 0.05, 0.99: 0.001, 1: 0}, false},
+		{"percent instead of quantile", map[float64]float64{95: 0.01}, true},
+		{"zero quantile", map[float64]float64{0: 0.01}, true},
+		{"negative error", map[float64]float64{0.5: -0.01}, true},
+		{"error of one", map[float64]float64{0.5: 1}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Collect: map[string]Collector{"latency": {Type: Summary, Objectives: test.objectives}}}
+			_, err := c.getCollectors()
+			if test.wantErr {
+				assert.ErrorContains(t, err, "latency")
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_Config_Names(t *testing.T) {
+	tests := []struct {
+		name      string
+		metric    string
+		collector Collector
+		wantErr   bool
+	}{
+		{"valid", "http_requests_total", Collector{Type: Counter, Namespace: "app", Subsystem: "http", Labels: []string{"method"}}, false},
+		{"colon", "job:requests:rate5m", Collector{Type: Gauge}, false},
+		{"dash", "http-requests", Collector{Type: Counter}, true},
+		{"leading digit", "1requests", Collector{Type: Counter}, true},
+		{"namespace", "requests", Collector{Type: Counter, Namespace: "my-app"}, true},
+		{"subsystem", "requests", Collector{Type: Counter, Subsystem: "http.server"}, true},
+		{"label", "requests", Collector{Type: Counter, Labels: []string{"status-code"}}, true},
+		{"reserved label", "requests", Collector{Type: Counter, Labels: []string{"__name"}}, true},
+		{"const label", "requests", Collector{Type: Counter, ConstLabels: map[string]string{"0region": "eu"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Collect: map[string]Collector{test.metric: test.collector}}
+			_, err := c.getCollectors()
+			if test.wantErr {
+				assert.ErrorContains(t, err, test.metric)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_Config_Validate(t *testing.T) {
+	c := &Config{
+		Collect: map[string]Collector{
+			"ok":        {Type: Counter},
+			"bad-name":  {Type: Counter},
+			"unsorted":  {Type: Histogram, Buckets: []float64{1, 0.5}},
+			"objective": {Type: Summary, Objectives: map[float64]float64{95: 0.01}},
+			"reserved":  {Type: Histogram, ConstLabels: map[string]string{"le": "1"}},
+		},
+		Timeouts: &Timeouts{Read: -time.Second},
+	}
+
+	err := c.Validate()
+	require.Error(t, err)
+	for _, name := range []string{"timeouts", "bad-name", "unsorted", "objective", "reserved"} {
+		assert.ErrorContains(t, err, name)
+	}
+
+	assert.NotContains(t, err.Error(), "`ok`")
+	assert.Equal(t, []string{"127.0.0.1:2112"}, c.Addresses)
+	assert.NoError(t, (&Config{Collect: map[string]Collector{"ok": {Type: Counter}}}).Validate())
+}
+
+func Test_Config_RequireHelp(t *testing.T) {
+	c := &Config{Collect: map[string]Collector{"requests": {Type: Counter}}}
+	require.NoError(t, c.Validate())
+
+	c.RequireHelp = true
+	assert.ErrorContains(t, c.Validate(), "requests")
+
+	_, err := c.getCollectors()
+	assert.ErrorContains(t, err, "requests")
+
+	c.Collect["requests"] = Collector{Type: Counter, Help: "Requests."}
+	_, err = c.getCollectors()
+	assert.NoError(t, err)
+}
+
+func Test_Config_ExpandEnv(t *testing.T) {
+	t.Setenv("RR_METRICS_TEST_REGION", "eu")
+	t.Setenv("RR_METRICS_TEST_POD", "pod-1")
+
+	c := &Config{Collect: map[string]Collector{
+		"requests": {
+			Type:        Counter,
+			Namespace:   "app_${RR_METRICS_TEST_REGION}",
+			Help:        "Requests of $RR_METRICS_TEST_POD, in $.",
+			ConstLabels: map[string]string{"pod": "${RR_METRICS_TEST_POD}"},
+		},
+	}}
+	require.NoError(t, c.Validate())
+
+	cl, err := c.getCollectors()
+	require.NoError(t, err)
+	def := cl["requests"].def
+	assert.Equal(t, "app_eu", def.Namespace)
+	assert.Equal(t, "Requests of pod-1, in $.", def.Help)
+	assert.Equal(t, map[string]string{"pod": "pod-1"}, def.ConstLabels)
+	// the configuration itself is left intact
+	assert.Equal(t, "${RR_METRICS_TEST_POD}", c.Collect["requests"].ConstLabels["pod"])
+
+	c.Collect["requests"] = Collector{Type: Counter, Subsystem: "${RR_METRICS_TEST_UNSET}"}
+	assert.ErrorContains(t, c.Validate(), "RR_METRICS_TEST_UNSET")
+	_, err = c.getCollectors()
+	assert.ErrorContains(t, err, "RR_METRICS_TEST_UNSET")
+
+	c.AllowUnsetEnv = true
+	cl, err = c.getCollectors()
+	require.NoError(t, err)
+	assert.Empty(t, cl["requests"].def.Subsystem)
+}
+
+func Test_Config_Const(t *testing.T) {
+	c := &Config{Collect: map[string]Collector{
+		"pool_size": {
+			Type:   Gauge,
+			Help:   "Configured pool size.",
+			Labels: []string{"pool"},
+			Const: []ConstSample{
+				{Labels: map[string]string{"pool": "http"}, Value: 8},
+				{Labels: map[string]string{"pool": "jobs"}, Value: 4},
+			},
+		},
+	}}
+	require.NoError(t, c.Validate())
+
+	cl, err := c.getCollectors()
+	require.NoError(t, err)
+
+	expected := `
+# HELP pool_size Configured pool size.
+# TYPE pool_size gauge
+pool_size{pool="http"} 8
+pool_size{pool="jobs"} 4
+`
+	require.NoError(t, testutil.CollectAndCompare(cl["pool_size"].col, strings.NewReader(expected)))
+
+	r := newTestRPC(t)
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "pool_size", Collector: c.Collect["pool_size"]}, &ok))
+	assert.ErrorContains(t, r.Set(&Metric{Name: "pool_size", Value: 1, Labels: []string{"http"}}, &ok), "is const")
+
+	for _, samples := range [][]ConstSample{
+		{{Labels: map[string]string{"other": "http"}, Value: 1}},
+		{{Labels: map[string]string{"pool": "http"}}, {Labels: map[string]string{"pool": "http"}}},
+	} {
+		c.Collect["pool_size"] = Collector{Type: Gauge, Labels: []string{"pool"}, Const: samples}
+		assert.Error(t, c.Validate())
+	}
+
+	c.Collect["pool_size"] = Collector{Type: Histogram, Const: []ConstSample{{Value: 1}}}
+	assert.ErrorContains(t, c.Validate(), "only gauges and counters")
+
+	// the series of the const collector are fixed, the series guards would be silently ignored
+	samples := []ConstSample{{Labels: map[string]string{"pool": "http"}, Value: 8}}
+	c.Collect["pool_size"] = Collector{Type: Gauge, Labels: []string{"pool"}, Const: samples, TTL: time.Minute}
+	assert.ErrorContains(t, c.Validate(), "ttl")
+	c.Collect["pool_size"] = Collector{Type: Gauge, Labels: []string{"pool"}, Const: samples, MaxCardinality: 2}
+	assert.ErrorContains(t, c.Validate(), "max_cardinality")
+}
+
+func Test_Config_MaxHeaderBytes(t *testing.T) {
+	c := &Config{}
+	c.InitDefaults()
+	assert.Equal(t, maxHeaderSize, c.MaxHeaderBytes)
+
+	c = &Config{MaxHeaderBytes: 8 << 10}
+	c.InitDefaults()
+	assert.Equal(t, 8<<10, c.MaxHeaderBytes)
+	assert.NoError(t, c.validate())
+
+	c.MaxHeaderBytes = -1
+	assert.ErrorContains(t, c.validate(), "max_header_bytes")
+}
+
+func Test_Config_SanitizeNames(t *testing.T) {
+	tests := map[string]string{
+		"requests_total":       "requests_total",
+		"http.requests":        "http_requests",
+		"api-gateway.latency":  "api_gateway_latency",
+		"jobs:rate5m":          "jobs:rate5m",
+		"5xx.count":            "_5xx_count",
+		"queue size":           "queue_size",
+		"naïve":                "na_ve",
+		"":                     "",
+		"already_valid_123":    "already_valid_123",
+		"stats/requests/total": "stats_requests_total",
+	}
+
+	for in, want := range tests {
+		assert.Equal(t, want, sanitizeMetricName(in), in)
+	}
+
+	c := &Config{Collect: map[string]Collector{"http.requests": {Type: Counter, Namespace: "my-app"}}}
+	assert.Error(t, c.Validate())
+
+	c.SanitizeNames = true
+	require.NoError(t, c.Validate())
+
+	cols, err := c.getCollectors()
+	require.NoError(t, err)
+	// the collector keeps the original name for the RPC calls
+	require.Contains(t, cols, "http.requests")
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(cols["http.requests"].col))
+	n, err := testutil.GatherAndCount(reg, "my_app_http_requests")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func Test_Config_RequireCollectors(t *testing.T) {
+	c := &Config{}
+	require.NoError(t, c.Validate())
+
+	c.RequireCollectors = true
+	assert.ErrorContains(t, c.Validate(), "require_collectors")
+
+	c.Collect = map[string]Collector{"requests": {Type: Counter}}
+	assert.NoError(t, c.Validate())
+
+	c.Collect = nil
+	c.Groups = map[string]Group{"http": {Collect: map[string]Collector{"requests": {Type: Counter}}}}
+	assert.NoError(t, c.Validate())
+}
+
+func Test_Config_Groups(t *testing.T) {
+	c := &Config{
+		Collect: map[string]Collector{
+			"uptime": {Type: Gauge},
+		},
+		Groups: map[string]Group{
+			"http": {
+				Namespace:   "app",
+				Subsystem:   "http",
+				ConstLabels: map[string]string{"team": "web", "tier": "front"},
+				Collect: map[string]Collector{
+					"requests_total": {Type: Counter},
+					"legacy_total":   {Type: Counter, Namespace: "legacy", ConstLabels: map[string]string{"tier": "edge"}},
+				},
+			},
+			"jobs": {
+				Namespace: "app",
+				Subsystem: "jobs",
+				Collect: map[string]Collector{
+					"pushed_total": {Type: Counter},
+				},
+			},
+		},
+	}
+	require.NoError(t, c.Validate())
+
+	cl, err := c.getCollectors()
+	require.NoError(t, err)
+	require.Len(t, cl, 4)
+
+	assert.Empty(t, cl["uptime"].def.Namespace)
+
+	def := cl["requests_total"].def
+	assert.Equal(t, "app", def.Namespace)
+	assert.Equal(t, "http", def.Subsystem)
+	assert.Equal(t, map[string]string{"team": "web", "tier": "front"}, def.ConstLabels)
+
+	// the collector settings take precedence over the group defaults
+	def = cl["legacy_total"].def
+	assert.Equal(t, "legacy", def.Namespace)
+	assert.Equal(t, "http", def.Subsystem)
+	assert.Equal(t, map[string]string{"team": "web", "tier": "edge"}, def.ConstLabels)
+	assert.Equal(t, map[string]string{"tier": "edge"}, c.Groups["http"].Collect["legacy_total"].ConstLabels)
+
+	assert.Equal(t, "app", cl["pushed_total"].def.Namespace)
+	assert.Equal(t, "jobs", cl["pushed_total"].def.Subsystem)
+
+	// the names are shared by the collect section and all groups
+	c.Groups["jobs"].Collect["uptime"] = Collector{Type: Gauge}
+	assert.ErrorContains(t, c.Validate(), "groups.jobs: collector `uptime` is already defined")
+	_, err = c.getCollectors()
+	assert.Error(t, err)
+}
+
+func Test_Config_EnforceUnits(t *testing.T) {
+	c := &Config{EnforceUnits: true}
+
+	for name, msg := range map[string]string{
+		"latency_ms":                "name it `latency_seconds`",
+		"job_duration_milliseconds": "name it `job_duration_seconds`",
+		"request_duration":          "name it `request_duration_seconds`",
+		"response_time":             "name it `response_time_seconds`",
+		"payload_kb":                "name it `payload_bytes`",
+		"response_bytes_size":       "e.g. `response_size_bytes`",
+	} {
+		err := c.checkUnits(name, &Collector{Type: Histogram})
+		assert.ErrorContains(t, err, msg, name)
+	}
+
+	for _, name := range []string{"request_duration_seconds", "response_size_bytes", "batch_size", "ms", "queue_depth"} {
+		assert.NoError(t, c.checkUnits(name, &Collector{Type: Summary}), name)
+	}
+
+	// only the histograms and summaries are checked
+	assert.NoError(t, c.checkUnits("latency_ms", &Collector{Type: Gauge}))
+
+	c.Collect = map[string]Collector{"latency_ms": {Type: Histogram}}
+	assert.ErrorContains(t, c.Validate(), "latency_ms")
+	_, err := c.getCollectors()
+	assert.Error(t, err)
+
+	c.EnforceUnits = false
+	assert.NoError(t, c.Validate())
+}
+
+func Test_Config_SummaryWindow(t *testing.T) {
+	c := &Config{Collect: map[string]Collector{
+		"latency": {
+			Type:       Summary,
+			Objectives: map[float64]float64{0.5: 0.05},
+			MaxAge:     time.Millisecond * 100,
+			AgeBuckets: 1,
+			BufCap:     10,
+		},
+	}}
+	require.NoError(t, c.Validate())
+
+	cl, err := c.getCollectors()
+	require.NoError(t, err)
+
+	summary := cl["latency"].col.(prometheus.Summary)
+	summary.Observe(2)
+
+	write := func() *dto.Summary {
+		m := &dto.Metric{}
+		require.NoError(t, summary.(prometheus.Metric).Write(m))
+		return m.GetSummary()
+	}
+	assert.Equal(t, float64(2), write().GetQuantile()[0].GetValue())
+
+	// the observation leaves the sliding window after max_age, the count is cumulative
+	require.Eventually(t, func() bool {
+		return math.IsNaN(write().GetQuantile()[0].GetValue())
+	}, time.Second*5, time.Millisecond*20)
+	assert.Equal(t, uint64(1), write().GetSampleCount())
+
+	c.Collect["latency"] = Collector{Type: Summary, MaxAge: -time.Second}
+	assert.ErrorContains(t, c.Validate(), "max_age should not be negative")
+}
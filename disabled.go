@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// withoutDisabled skips the metric families of the disabled collectors.
+func (p *Plugin) withoutDisabled(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		skip := p.disabledFamilies()
+		if len(skip) == 0 {
+			return mfs, err
+		}
+
+		out := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			if _, ok := skip[mf.GetName()]; !ok {
+				out = append(out, mf)
+			}
+		}
+
+		return out, err
+	})
+}
+
+// disabledFamilies returns the names of the families exposed by the disabled collectors.
+func (p *Plugin) disabledFamilies() map[string]struct{} {
+	var names map[string]struct{}
+	p.collectors.Range(func(_, value any) bool {
+		disabled := value.(*collector).disabled.Load()
+		if disabled == nil {
+			return true
+		}
+
+		if names == nil {
+			names = make(map[string]struct{})
+		}
+		for _, name := range *disabled {
+			names[name] = struct{}{}
+		}
+
+		return true
+	})
+
+	return names
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// federateHandler exposes only the metric families matched by the match[] globs, e.g. match[]=app_http_* , so a
+// central Prometheus can pull a curated subset. Unlike the Prometheus federation, the matchers are the name globs
+// (path.Match syntax), not the series selectors.
+func federateHandler(g prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		patterns := req.URL.Query()["match[]"]
+		if len(patterns) == 0 {
+			http.Error(w, "at least one match[] parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				http.Error(w, fmt.Sprintf("invalid match[] `%s`: %v", p, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// the patterns differ per scrape, the handler is cheap to build
+		promhttp.HandlerFor(matching(g, patterns), opts).ServeHTTP(w, req)
+	})
+}
+
+// matching keeps the families whose name matches any of the (valid) patterns.
+func matching(g prometheus.Gatherer, patterns []string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		out := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			if slices.ContainsFunc(patterns, func(p string) bool {
+				ok, _ := path.Match(p, mf.GetName())
+				return ok
+			}) {
+				out = append(out, mf)
+			}
+		}
+
+		return out, err
+	})
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// pprofHandlers are the net/http/pprof handlers served with enable_pprof, keyed by their paths.
+var pprofHandlers = map[string]http.HandlerFunc{
+	"/debug/pprof/":        pprof.Index,
+	"/debug/pprof/cmdline": pprof.Cmdline,
+	"/debug/pprof/profile": pprof.Profile,
+	"/debug/pprof/symbol":  pprof.Symbol,
+	"/debug/pprof/trace":   pprof.Trace,
+}
+
+// handler builds the metrics HTTP handler with all configured middleware.
+func (p *Plugin) handler() http.Handler {
+	// the concurrency limit is shared by all scrape endpoints, the promhttp one would be separate for every handler
+	opts := promhttp.HandlerOpts{
+		// scrapers which do not ask for OpenMetrics in the Accept header still get the text format
+		EnableOpenMetrics: p.cfg.EnableOpenMetrics,
+		Timeout:           p.cfg.ScrapeTimeout,
+	}
+	limit := newScrapeLimit(p.cfg.MaxScrapeRequests)
+
+	if c := p.cfg.Compression; c != nil {
+		opts.DisableCompression = c.Disable
+		if len(c.Encodings) > 0 {
+			// identity is used when the scraper does not accept any of the offered encodings
+			opts.OfferedCompressions = []promhttp.Compression{promhttp.Identity}
+			for _, enc := range c.Encodings {
+				opts.OfferedCompressions = append(opts.OfferedCompressions, promhttp.Compression(enc))
+			}
+		}
+	}
+
+	// the registerer writes into the registry, so gathering from it exposes the global labels as well
+	g := p.gatherer()
+	if p.cfg.ScrapeCacheTTL > 0 {
+		// shared by the scrape endpoints, each encodes the cached families in the negotiated format
+		g = newCachedGatherer(g, p.cfg.ScrapeCacheTTL)
+	}
+
+	var handler http.Handler = promhttp.HandlerFor(g, opts)
+	handler = limit.wrap(handler)
+	handler = scrapeTimestamp(handler, p.selfMetrics.lastScrape)
+
+	// the exposition format of the root registry (merged with the named ones) is still served on every other path
+	mux := http.NewServeMux()
+	mux.Handle("/metrics/{registry}", limit.wrap(p.registryHandler(opts)))
+	if p.cfg.EnableJSON {
+		mux.Handle(p.cfg.JSONPath, limit.wrap(jsonHandler(g, p.log)))
+	}
+	if p.cfg.EnableFederate {
+		mux.Handle(p.cfg.FederatePath, limit.wrap(federateHandler(g, opts)))
+	}
+	if p.cfg.EnablePprof {
+		// behind the same auth and allowlist as the scrapes
+		for path, h := range pprofHandlers {
+			mux.HandleFunc(path, h)
+		}
+	}
+	mux.Handle("/", handler)
+	handler = mux
+
+	if p.cfg.DebugHeaders {
+		handler = formatDebug(handler)
+	}
+
+	if p.cfg.BasicAuth != nil {
+		handler = basicAuth(handler, p.cfg.BasicAuth)
+	}
+	if len(p.allowedNets) > 0 {
+		handler = allowlist(handler, p.allowedNets, p.trustedProxies)
+	}
+
+	// exposes the number of scrapes by status code (including the rejected ones) and the scrapes in flight,
+	// already registered metrics are reused, so the handler can be rebuilt
+	handler = promhttp.InstrumentMetricHandler(p.registerer, handler)
+	// the cost of serving the metrics, measured outside of the limit so the rejected scrapes are observed as well
+	handler = promhttp.InstrumentHandlerDuration(p.selfMetrics.scrapeDuration, handler)
+	handler = promhttp.InstrumentHandlerResponseSize(p.selfMetrics.scrapeSize, handler)
+
+	if p.cfg.ServerHeader != "" {
+		handler = serverHeader(handler, p.cfg.ServerHeader)
+	}
+	if p.cfg.LogRequests {
+		handler = accessLog(handler, p.log, p.trustedProxies)
+	}
+
+	return handler
+}
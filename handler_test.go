@@ -0,0 +1,487 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newTestPlugin(cfg *Config) *Plugin {
+	cfg.InitDefaults()
+
+	p := &Plugin{
+		cfg:         cfg,
+		log:         zap.NewNop(),
+		registry:    prometheus.NewRegistry(),
+		selfMetrics: newSelfMetrics(),
+	}
+	p.registerer = p.registry
+
+	return p
+}
+
+func scrape(h http.Handler, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_Handler_OpenMetrics(t *testing.T) {
+	const openMetricsAccept = "application/openmetrics-text;version=1.0.0"
+
+	p := newTestPlugin(&Config{EnableOpenMetrics: true})
+	p.registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}))
+
+	rec := scrape(p.handler(), http.Header{"Accept": {openMetricsAccept}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/openmetrics-text")
+	assert.Contains(t, rec.Body.String(), "# EOF")
+
+	// scrapers without the OpenMetrics Accept header still get the text format
+	rec = scrape(p.handler(), nil)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.NotContains(t, rec.Body.String(), "# EOF")
+
+	p.cfg.EnableOpenMetrics = false
+	rec = scrape(p.handler(), http.Header{"Accept": {openMetricsAccept}})
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func Test_Handler_TargetInfo(t *testing.T) {
+	p := newTestPlugin(&Config{EnableOpenMetrics: true})
+
+	ti, err := newTargetInfo(map[string]string{"service": "api", "region": "eu"})
+	require.NoError(t, err)
+	p.registry.MustRegister(ti)
+
+	rec := scrape(p.handler(), http.Header{"Accept": {"application/openmetrics-text;version=1.0.0"}})
+	assert.Contains(t, rec.Body.String(), `target_info{region="eu",service="api"} 1.0`)
+}
+
+func Test_Handler_Compression(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	p.registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}))
+
+	rec := scrape(p.handler(), http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "requests_total")
+
+	p.cfg.Compression = &Compression{Encodings: []string{"zstd"}}
+	rec = scrape(p.handler(), http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Contains(t, rec.Body.String(), "requests_total")
+
+	p.cfg.Compression = &Compression{Disable: true}
+	rec = scrape(p.handler(), http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+
+	assert.Error(t, (&Config{Compression: &Compression{Encodings: []string{"br"}}}).validate())
+}
+
+type testGathererProvider struct {
+	registry *prometheus.Registry
+}
+
+func (g *testGathererProvider) MetricsGatherer() prometheus.Gatherer {
+	return g.registry
+}
+
+func Test_Handler_GathererProvider(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	p.registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}))
+
+	sub := prometheus.NewRegistry()
+	sub.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "jobs_queued", Help: "Queued jobs."}))
+	p.gathererProviders = append(p.gathererProviders, &testGathererProvider{registry: sub})
+
+	rec := scrape(p.handler(), nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "requests_total 0")
+	assert.Contains(t, rec.Body.String(), "jobs_queued 0")
+}
+
+func Test_Handler_Instrumented(t *testing.T) {
+	p := newTestPlugin(&Config{})
+
+	scrape(p.handler(), nil)
+	rec := scrape(p.handler(), nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `promhttp_metric_handler_requests_total{code="200"} 1`)
+	assert.Contains(t, rec.Body.String(), "promhttp_metric_handler_requests_in_flight 1")
+
+	// the scrape duration and the response size are observed after the response is written
+	p.registry.MustRegister(p.selfMetrics.scrapeDuration, p.selfMetrics.scrapeSize)
+	size := float64(rec.Body.Len())
+	rec = scrape(p.handler(), nil)
+	assert.Contains(t, rec.Body.String(), `rr_metrics_scrape_duration_seconds_count{code="200"} 2`)
+	assert.Contains(t, rec.Body.String(), `rr_metrics_scrape_response_size_bytes_count{code="200"} 2`)
+
+	families, err := p.registry.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() == "rr_metrics_scrape_response_size_bytes" {
+			assert.Greater(t, mf.GetMetric()[0].GetHistogram().GetSampleSum(), size)
+		}
+	}
+}
+
+// failingCollector is an unchecked collector failing every gather.
+type failingCollector struct{}
+
+func (failingCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (failingCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("broken", "Broken.", nil, nil), errors.New("broken"))
+}
+
+func Test_Handler_LastScrape(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	assert.Zero(t, testutil.ToFloat64(p.selfMetrics.lastScrape))
+
+	before := float64(time.Now().Unix())
+	scrape(p.handler(), nil)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(p.selfMetrics.lastScrape), before)
+
+	// the failed scrapes are not recorded
+	p.selfMetrics.lastScrape.Set(0)
+	p.registry.MustRegister(failingCollector{})
+	rec := scrape(p.handler(), nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Zero(t, testutil.ToFloat64(p.selfMetrics.lastScrape))
+}
+
+func Test_Handler_JSON(t *testing.T) {
+	p := newTestPlugin(&Config{EnableJSON: true})
+	require.NoError(t, p.cfg.validate())
+
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency.", Buckets: []float64{1}}, []string{"method"})
+	p.registry.MustRegister(histogram)
+	histogram.WithLabelValues("GET").Observe(0.5)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics.json", nil)
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, req)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var families []jsonFamily
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &families))
+
+	var latency *jsonFamily
+	for i := range families {
+		if families[i].Name == "latency_seconds" {
+			latency = &families[i]
+		}
+	}
+	require.NotNil(t, latency)
+	assert.Equal(t, "histogram", latency.Type)
+	assert.Equal(t, []jsonSample{
+		{Name: "latency_seconds_bucket", Labels: map[string]string{"method": "GET", "le": "1"}, Value: "1"},
+		{Name: "latency_seconds_bucket", Labels: map[string]string{"method": "GET", "le": "+Inf"}, Value: "1"},
+		{Name: "latency_seconds_sum", Labels: map[string]string{"method": "GET"}, Value: "0.5"},
+		{Name: "latency_seconds_count", Labels: map[string]string{"method": "GET"}, Value: "1"},
+	}, latency.Samples)
+
+	// the exposition format is still served
+	rec = scrape(p.handler(), nil)
+	assert.Contains(t, rec.Body.String(), "latency_seconds_count")
+}
+
+func Test_Handler_Registries(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	r := &rpc{p: p, log: p.log}
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests_total", Collector: Collector{Type: Counter, Help: "Requests."}}, &ok))
+	require.NoError(t, r.DeclareInRegistry(&RegistryCollector{
+		Registry:       "tenant_a",
+		NamedCollector: NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Help: "Jobs."}},
+	}, &ok))
+	require.NoError(t, r.Inc("jobs_total", &ok))
+
+	// the names are shared by the registries, the other tenant can't take over the collector
+	err := r.DeclareInRegistry(&RegistryCollector{
+		Registry:       "tenant_b",
+		NamedCollector: NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Help: "Jobs."}},
+	}, &ok)
+	assert.Equal(t, CodeInvalidCollector, Code(err))
+	assert.Equal(t, CodeInvalidCollector, Code(r.Declare(&NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter}}, &ok)))
+	require.NoError(t, r.DeclareInRegistry(&RegistryCollector{
+		Registry:       "tenant_a",
+		NamedCollector: NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Help: "Jobs."}},
+	}, &ok))
+
+	// the registry created for the collector which failed to register is not left behind
+	p.cfg.Labels = map[string]string{"env": "test"}
+	err = r.DeclareInRegistry(&RegistryCollector{
+		Registry:       "tenant_c",
+		NamedCollector: NamedCollector{Name: "env_total", Collector: Collector{Type: Counter, Help: "Env.", Labels: []string{"env"}}},
+	}, &ok)
+	assert.Equal(t, CodeRegistry, Code(err))
+	_, exist := p.registries.Load("tenant_c")
+	assert.False(t, exist)
+	p.cfg.Labels = nil
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/metrics/tenant_a")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "jobs_total 1")
+	assert.NotContains(t, rec.Body.String(), "requests_total")
+
+	// the root path unions all registries
+	rec = get("/metrics")
+	assert.Contains(t, rec.Body.String(), "jobs_total 1")
+	assert.Contains(t, rec.Body.String(), "requests_total 0")
+
+	assert.Equal(t, http.StatusNotFound, get("/metrics/tenant_b").Code)
+	assert.Error(t, r.DeclareInRegistry(&RegistryCollector{Registry: "bad/name", NamedCollector: NamedCollector{Name: "x", Collector: Collector{Type: Counter}}}, &ok))
+
+	require.NoError(t, r.Unregister("jobs_total", &ok))
+	assert.NotContains(t, get("/metrics/tenant_a").Body.String(), "jobs_total")
+
+	require.NoError(t, r.DeclareInRegistry(&RegistryCollector{
+		Registry:       "tenant_a",
+		NamedCollector: NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Help: "Jobs."}},
+	}, &ok))
+	require.NoError(t, r.DropRegistry("tenant_a", &ok))
+	assert.Equal(t, http.StatusNotFound, get("/metrics/tenant_a").Code)
+	assert.NotContains(t, get("/metrics").Body.String(), "jobs_total")
+	_, exist = p.collectors.Load("jobs_total")
+	assert.False(t, exist)
+	assert.Equal(t, CodeUndefinedRegistry, Code(r.DropRegistry("tenant_a", &ok)))
+}
+
+func Test_Handler_Relabel(t *testing.T) {
+	p := newTestPlugin(&Config{Relabel: []Relabel{
+		{Source: "app_reqs", Target: "app_requests_total"},
+		{Source: "app_debug", Drop: true},
+		{Source: "app_jobs", Target: "app_workers"},
+	}})
+	require.NoError(t, p.cfg.validate())
+
+	for _, name := range []string{"app_reqs", "app_debug", "app_jobs", "app_workers"} {
+		p.registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name}))
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	p.log = zap.New(core)
+
+	// the conflicting rule is skipped, the scrape doesn't fail
+	mfs, err := p.gatherer().Gather()
+	require.NoError(t, err)
+	_, err = p.gatherer().Gather()
+	require.NoError(t, err)
+
+	entries := logs.FilterMessage("relabel rule skipped, the target already exists").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "app_jobs", entries[0].ContextMap()["source"])
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	names := make([]string, 0, len(mfs))
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.Equal(t, []string{"app_jobs", "app_requests_total", "app_workers"}, names)
+
+	assert.Error(t, (&Config{Relabel: []Relabel{{Source: "app_reqs"}}}).validate())
+	assert.Error(t, (&Config{Relabel: []Relabel{{Source: "app_reqs", Target: "x", Drop: true}}}).validate())
+}
+
+func Test_Handler_TimestampSamples(t *testing.T) {
+	p := newTestPlugin(&Config{TimestampSamples: true})
+	p.registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}))
+
+	before := time.Now().UnixMilli()
+	mfs, err := p.gatherer().Gather()
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+	assert.GreaterOrEqual(t, mfs[0].GetMetric()[0].GetTimestampMs(), before)
+
+	// the registry output is not modified
+	mfs, err = p.registry.Gather()
+	require.NoError(t, err)
+	assert.Nil(t, mfs[0].GetMetric()[0].TimestampMs)
+}
+
+func Test_Handler_Pprof(t *testing.T) {
+	get := func(h http.Handler, path string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the metrics are served on the pprof path when disabled
+	rec := get(newTestPlugin(&Config{}).handler(), "/debug/pprof/", false)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "profile")
+
+	h := newTestPlugin(&Config{EnablePprof: true, BasicAuth: &BasicAuth{Username: "admin", Password: "secret"}}).handler()
+	assert.Equal(t, http.StatusUnauthorized, get(h, "/debug/pprof/", false).Code)
+
+	rec = get(h, "/debug/pprof/", true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine")
+
+	rec = get(h, "/debug/pprof/cmdline", true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func Test_Handler_DebugHeaders(t *testing.T) {
+	get := func(h http.Handler, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(newTestPlugin(&Config{}).handler(), "/metrics", "")
+	assert.Empty(t, rec.Header().Get(formatHeader))
+
+	h := newTestPlugin(&Config{DebugHeaders: true, EnableOpenMetrics: true, EnableJSON: true}).handler()
+	assert.Equal(t, "text", get(h, "/metrics", "").Header().Get(formatHeader))
+	assert.Equal(t, "openmetrics", get(h, "/metrics", "application/openmetrics-text; version=1.0.0").Header().Get(formatHeader))
+	assert.Equal(t, "protobuf", get(h, "/metrics", "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited").Header().Get(formatHeader))
+
+	// the scraper asked for OpenMetrics, but it is disabled
+	h = newTestPlugin(&Config{DebugHeaders: true}).handler()
+	assert.Equal(t, "text", get(h, "/metrics", "application/openmetrics-text; version=1.0.0").Header().Get(formatHeader))
+
+	// not an exposition
+	h = newTestPlugin(&Config{DebugHeaders: true, EnableJSON: true}).handler()
+	rec = get(h, "/metrics.json", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(formatHeader))
+}
+
+func Test_Handler_Federate(t *testing.T) {
+	p := newTestPlugin(&Config{EnableFederate: true})
+	for _, name := range []string{"app_http_requests_total", "app_http_errors_total", "app_jobs_total"} {
+		c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: "Test."})
+		c.Inc()
+		p.registry.MustRegister(c)
+	}
+	h := p.handler()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/federate?match[]=app_http_*")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "app_http_requests_total 1")
+	assert.Contains(t, rec.Body.String(), "app_http_errors_total 1")
+	assert.NotContains(t, rec.Body.String(), "app_jobs_total")
+	assert.NotContains(t, rec.Body.String(), "go_goroutines")
+
+	rec = get("/federate?match[]=app_http_errors_total&match[]=app_jobs_*")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "app_http_requests_total")
+	assert.Contains(t, rec.Body.String(), "app_jobs_total 1")
+
+	assert.Equal(t, http.StatusBadRequest, get("/federate").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/federate?match[]=app_[").Code)
+
+	// the full exposition is still served on the other paths
+	assert.Contains(t, get("/metrics").Body.String(), "app_jobs_total 1")
+
+	assert.Error(t, (&Config{EnableFederate: true, FederatePath: "federate"}).validate())
+
+	// a path served twice would make the mux panic
+	for _, cfg := range []*Config{
+		{EnableFederate: true, FederatePath: "/metrics.json", EnableJSON: true, JSONPath: "/metrics.json"},
+		{EnableFederate: true, FederatePath: "/debug/pprof/", EnablePprof: true},
+		{EnableJSON: true, JSONPath: "/metrics/{registry}"},
+		{EnableFederate: true, FederatePath: "/metrics/{name}"},
+		{EnableFederate: true, FederatePath: "GET /federate"},
+	} {
+		assert.Error(t, cfg.validate(), "%s %s", cfg.JSONPath, cfg.FederatePath)
+	}
+	assert.NoError(t, (&Config{EnableFederate: true, FederatePath: "/debug/pprof/", EnableJSON: true, JSONPath: "/metrics.json"}).validate())
+}
+
+func Test_Handler_ScrapeLimits(t *testing.T) {
+	// blockingGauge holds the gather until released
+	blockingGauge := func(p *Plugin) (started, release chan struct{}) {
+		started, release = make(chan struct{}, 1), make(chan struct{})
+		p.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "slow", Help: "Slow."}, func() float64 {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return 1
+		}))
+		return started, release
+	}
+
+	p := newTestPlugin(&Config{MaxScrapeRequests: 1, EnableJSON: true, EnableFederate: true})
+	started, release := blockingGauge(p)
+	_, err := p.subRegistry("tenant_a")
+	require.NoError(t, err)
+	h := p.handler()
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		done <- rec.Code
+	}()
+	<-started
+
+	// the limit is shared by all scrape endpoints
+	for _, path := range []string{"/metrics", "/metrics/tenant_a", "/metrics.json", "/federate?match[]=slow"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, path)
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// a stuck gather is answered with 503 instead of hanging
+	p = newTestPlugin(&Config{ScrapeTimeout: time.Millisecond * 50})
+	_, release = blockingGauge(p)
+	t.Cleanup(func() { close(release) })
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
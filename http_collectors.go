@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HTTPCollectors are the standard HTTP server (RED) metrics, fed by the http plugin. They are registered only when
+// the plugin returns them from its StatProvider.MetricsCollector.
+type HTTPCollectors struct {
+	duration     *prometheus.HistogramVec
+	inFlight     prometheus.Gauge
+	responseSize *prometheus.HistogramVec
+}
+
+var _ StatProvider = (*HTTPCollectors)(nil)
+
+// NewHTTPCollectors creates the HTTP server collectors in the given namespace.
+func NewHTTPCollectors(namespace string) *HTTPCollectors {
+	return &HTTPCollectors{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the HTTP requests by method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "Number of the HTTP requests being served.",
+		}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "response_size_bytes",
+			Help:      "Size of the HTTP responses by method and status code.",
+			// 100B to 100MB
+			Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+		}, []string{"method", "code"}),
+	}
+}
+
+// Collectors returns the collectors, e.g. to be appended to the collectors of the StatProvider implementer.
+func (h *HTTPCollectors) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{h.duration, h.inFlight, h.responseSize}
+}
+
+// MetricsCollector returns the collectors, so they can be provided via the StatProvider as is.
+func (h *HTTPCollectors) MetricsCollector() []prometheus.Collector {
+	return h.Collectors()
+}
+
+// RequestStarted accounts the request in flight, should be paired with RequestFinished.
+func (h *HTTPCollectors) RequestStarted() {
+	h.inFlight.Inc()
+}
+
+// RequestFinished observes the completed request.
+func (h *HTTPCollectors) RequestFinished(method string, code int, duration time.Duration, size int64) {
+	h.inFlight.Dec()
+
+	status := strconv.Itoa(code)
+	h.duration.WithLabelValues(method, status).Observe(duration.Seconds())
+	h.responseSize.WithLabelValues(method, status).Observe(float64(size))
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HTTPCollectors(t *testing.T) {
+	h := NewHTTPCollectors("rr")
+
+	p := newTestPlugin(&Config{})
+	p.statProviders = []StatProvider{h}
+	p.registerStatProviders()
+
+	h.RequestStarted()
+	h.RequestStarted()
+	assert.Equal(t, float64(2), testutil.ToFloat64(h.inFlight))
+
+	h.RequestFinished(http.MethodGet, http.StatusOK, time.Millisecond*200, 512)
+	assert.Equal(t, float64(1), testutil.ToFloat64(h.inFlight))
+
+	expected := `
+# HELP rr_http_response_size_bytes Size of the HTTP responses by method and status code.
+# TYPE rr_http_response_size_bytes histogram
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="100"} 0
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="1000"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="10000"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="100000"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="1e+06"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="1e+07"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="1e+08"} 1
+rr_http_response_size_bytes_bucket{code="200",method="GET",le="+Inf"} 1
+rr_http_response_size_bytes_sum{code="200",method="GET"} 512
+rr_http_response_size_bytes_count{code="200",method="GET"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(p.registry, strings.NewReader(expected), "rr_http_response_size_bytes"))
+
+	n, err := testutil.GatherAndCount(p.registry, "rr_http_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// the http plugin provides them along with its own collectors
+	cols := NewHTTPCollectors("app").Collectors()
+	require.Len(t, cols, 3)
+	p = newTestPlugin(&Config{})
+	for _, c := range cols {
+		require.NoError(t, p.Register(c))
+	}
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// jsonFamily is the JSON form of a metric family.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Help    string       `json:"help,omitempty"`
+	Samples []jsonSample `json:"samples"`
+}
+
+// jsonSample is a single sample in the exposition form, the value is a string as NaN and Inf are not valid JSON numbers.
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  string            `json:"value"`
+}
+
+// jsonHandler exposes the gathered metrics as JSON for the tools which can't parse the exposition format.
+func jsonHandler(g prometheus.Gatherer, log *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			// gather errors are not fatal, the families that were gathered are still returned
+			log.Warn("failed to gather some metrics for the json endpoint", zap.Error(err))
+		}
+
+		families := make([]jsonFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			families = append(families, toJSONFamily(mf))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(families)
+		if err != nil {
+			log.Debug("failed to write the json metrics", zap.Error(err))
+		}
+	})
+}
+
+func toJSONFamily(mf *dto.MetricFamily) jsonFamily {
+	f := jsonFamily{
+		Name:    mf.GetName(),
+		Type:    strings.ToLower(mf.GetType().String()),
+		Help:    mf.GetHelp(),
+		Samples: make([]jsonSample, 0, len(mf.GetMetric())),
+	}
+
+	expandSamples(mf, func(_ *dto.Metric, name string, labels []label, value float64) {
+		s := jsonSample{Name: name, Value: formatFloat(value)}
+		if len(labels) > 0 {
+			s.Labels = make(map[string]string, len(labels))
+			for _, l := range labels {
+				s.Labels[l.name] = l.value
+			}
+		}
+
+		f.Samples = append(f.Samples, s)
+	})
+
+	return f
+}
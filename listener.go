@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	stderr "errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// unixScheme prefixes the addresses of the unix domain socket listeners, e.g. unix:///var/run/rr-metrics.sock
+	unixScheme = "unix://"
+	// initial delay between the listen attempts, doubled on every attempt
+	listenBackoff = time.Millisecond * 100
+)
+
+// unixSocketPath returns the socket path for the unix domain socket address.
+func unixSocketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, unixScheme)
+}
+
+// validateTCPAddress checks the host:port address before the listen, so a config mistake is not reported as
+// a bind error. The empty host listens on all interfaces.
+func validateTCPAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %s, should be either host:port or %s/path/to.sock: %w", addr, unixScheme, err)
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (n == 0 && port != "0") {
+		return fmt.Errorf("invalid port `%s` of the address %s, should be a number between 0 and 65535", port, addr)
+	}
+
+	return nil
+}
+
+// serve the metrics server (over TLS when configured) on its TCP or unix domain socket address, blocks until
+// the server is shut down.
+func (p *Plugin) serve(srv *http.Server) error {
+	ln, err := p.listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	p.addrs.Store(srv.Addr, ln.Addr())
+	p.log.Debug("metrics server is listening", zap.String("address", srv.Addr), zap.Stringer("bound", ln.Addr()))
+
+	if t := p.cfg.TLS; t != nil {
+		return srv.ServeTLS(ln, t.Cert, t.Key)
+	}
+
+	return srv.Serve(ln)
+}
+
+// listen on the address, retrying with a backoff while the address is still held by the previous process.
+func (p *Plugin) listen(addr string) (net.Listener, error) {
+	network, address := "tcp", addr
+	if path, ok := unixSocketPath(addr); ok {
+		network, address = "unix", path
+		// a socket left by the previous (crashed) process would fail the listen, a live one is kept, so the listen
+		// below fails with EADDRINUSE instead of taking the path over from the serving process
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket && staleSocket(path) {
+			_ = os.Remove(path)
+		}
+	}
+
+	backoff := listenBackoff
+	for attempt := 1; ; attempt++ {
+		ln, err := net.Listen(network, address)
+		if err == nil || !stderr.Is(err, syscall.EADDRINUSE) || attempt >= p.cfg.ListenAttempts {
+			return ln, err
+		}
+
+		p.log.Debug("metrics address is in use, retrying", zap.String("address", addr), zap.Int("attempt", attempt), zap.Duration("backoff", backoff))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// staleSocket reports whether no process accepts the connections on the socket anymore.
+func staleSocket(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return false
+	}
+
+	return stderr.Is(err, syscall.ECONNREFUSED)
+}
+
+// removeSocket removes the socket file of the unix domain socket listener, no-op for the TCP addresses.
+func removeSocket(addr string) error {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return nil
+	}
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
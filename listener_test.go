@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Listener_UnixSocket(t *testing.T) {
+	// unix socket paths are limited to ~100 bytes, t.TempDir might be too long
+	dir, err := os.MkdirTemp("", "rr-metrics")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "metrics.sock")
+	p := newTestPlugin(&Config{Address: unixScheme + path})
+	require.NoError(t, p.cfg.validate())
+
+	srv := &http.Server{Addr: p.cfg.Addresses[0], Handler: p.handler(), ReadHeaderTimeout: time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serve(srv)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://metrics/metrics")
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second*5, time.Millisecond*50)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-errCh, http.ErrServerClosed)
+	require.NoError(t, removeSocket(srv.Addr))
+	assert.NoFileExists(t, path)
+
+	p.cfg.Addresses = []string{unixScheme + filepath.Join(dir, "missing", "metrics.sock")}
+	assert.ErrorContains(t, p.cfg.validate(), "does not exist")
+}
+
+func Test_Listener_Retry(t *testing.T) {
+	// hold the port as the previous process would do
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := busy.Addr().String()
+
+	p := newTestPlugin(&Config{ListenAttempts: 1})
+	_, err = p.listen(addr)
+	assert.ErrorIs(t, err, syscall.EADDRINUSE)
+
+	time.AfterFunc(time.Millisecond*50, func() {
+		_ = busy.Close()
+	})
+
+	p.cfg.ListenAttempts = 5
+	ln, err := p.listen(addr)
+	require.NoError(t, err)
+	assert.NoError(t, ln.Close())
+}
+
+func Test_Listener_ValidateAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		err  string
+	}{
+		{addr: "127.0.0.1:2112"},
+		{addr: ":2112"},
+		{addr: "[::1]:2112"},
+		{addr: "localhost:0"},
+		{addr: "127.0.0.1", err: "missing port"},
+		{addr: "127.0.0.1:", err: "invalid port"},
+		{addr: "127.0.0.1:http", err: "invalid port"},
+		{addr: "127.0.0.1:70000", err: "invalid port"},
+		{addr: "http://127.0.0.1:2112", err: "too many colons"},
+		{addr: unixScheme + filepath.Join(t.TempDir(), "metrics.sock")},
+		{addr: unixScheme, err: "empty unix socket path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := (&Config{Address: tt.addr}).validate()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func Test_Listener_Addr(t *testing.T) {
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0"})
+	assert.Nil(t, p.Addr())
+
+	srv := &http.Server{Addr: p.cfg.Addresses[0], Handler: p.handler(), ReadHeaderTimeout: time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serve(srv)
+	}()
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second*5, time.Millisecond*10)
+
+	addr := p.Addr().(*net.TCPAddr)
+	assert.NotZero(t, addr.Port)
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics") //nolint:noctx
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-errCh, http.ErrServerClosed)
+}
+
+func Test_Listener_UnixSocketInUse(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rr-metrics")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "metrics.sock")
+	live, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	// the socket of a live process is not taken over
+	p := newTestPlugin(&Config{ListenAttempts: 1})
+	_, err = p.listen(unixScheme + path)
+	assert.ErrorIs(t, err, syscall.EADDRINUSE)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// the socket of a crashed process is replaced
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, live.Close())
+	require.FileExists(t, path)
+
+	ln, err := p.listen(unixScheme + path)
+	require.NoError(t, err)
+	assert.NoError(t, ln.Close())
+}
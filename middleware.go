@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth wraps the handler and verifies the Authorization header against the configured credentials.
+func basicAuth(next http.Handler, cfg *BasicAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !cfg.verify(username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowlist rejects the clients outside the allowed networks with 403.
+func allowlist(next http.Handler, nets, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(clientIP(r, proxies), nets) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowed(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP identifies the client. The X-Forwarded-For header is honoured only when the direct peer is one of the
+// trusted proxies, otherwise any client could set it. The client is the rightmost hop which is not a trusted proxy;
+// the hops on the left of it are set by the client and might be spoofed, so they are never used. Returns nil when
+// the client can't be identified.
+func clientIP(r *http.Request, proxies []*net.IPNet) net.IP {
+	peer := remoteIP(r)
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 || !allowed(peer, proxies) {
+		return peer
+	}
+
+	// multiple headers are a single comma-separated list
+	hops := strings.Split(strings.Join(values, ","), ",")
+
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(hops[i]))
+		if !allowed(ip, proxies) {
+			return ip
+		}
+	}
+
+	// every hop is a trusted proxy
+	return ip
+}
+
+// remoteIP returns the IP of the direct peer, nil for the peers without one (e.g. on a unix socket).
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// parseCIDRs parses the networks of the option.
+func parseCIDRs(option string, cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", option, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// accessLog logs every request with the client resolved like the allowlist does.
+func accessLog(next http.Handler, log *zap.Logger, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		var client string
+		if ip := clientIP(r, proxies); ip != nil {
+			client = ip.String()
+		}
+
+		log.Info("scrape request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", rw.status),
+			zap.Duration("duration", time.Since(start)),
+			zap.Int64("bytes", rw.bytes),
+			zap.String("client", client),
+		)
+	})
+}
+
+// responseRecorder captures the status code and the size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// scrapeTimestamp records the completion time of every successful scrape.
+func scrapeTimestamp(next http.Handler, gauge prometheus.Gauge) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if rw.status < http.StatusBadRequest {
+			gauge.SetToCurrentTime()
+		}
+	})
+}
+
+// scrapeLimit bounds the concurrent scrapes of all endpoints with a single semaphore, nil means unlimited.
+type scrapeLimit chan struct{}
+
+func newScrapeLimit(n int) scrapeLimit {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(scrapeLimit, n)
+}
+
+// wrap rejects the scrapes beyond the limit with 503, the same way as the promhttp MaxRequestsInFlight.
+func (l scrapeLimit) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l <- struct{}{}:
+			defer func() { <-l }()
+		default:
+			http.Error(w, fmt.Sprintf("limit of concurrent scrape requests reached (%d), try again later", cap(l)), http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serverHeader sets the Server header of every response, the Go HTTP server does not send one on its own.
+func serverHeader(next http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// formatHeader is the debug header with the exposition format negotiated with the scraper.
+const formatHeader = "X-RR-Metrics-Format"
+
+// formatDebug reports the negotiated exposition format in the X-RR-Metrics-Format header, see debug_headers.
+func formatDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&formatRecorder{ResponseWriter: w}, r)
+	})
+}
+
+// formatRecorder sets the format header from the content type chosen by the encoder, right before the headers are sent.
+type formatRecorder struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (f *formatRecorder) WriteHeader(code int) {
+	f.setFormat()
+	f.ResponseWriter.WriteHeader(code)
+}
+
+func (f *formatRecorder) Write(b []byte) (int, error) {
+	f.setFormat()
+	return f.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (f *formatRecorder) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+func (f *formatRecorder) setFormat() {
+	if f.written {
+		return
+	}
+	f.written = true
+
+	// the other responses (errors, json, pprof) are not expositions
+	var format string
+	switch expfmt.Format(f.Header().Get("Content-Type")).FormatType() {
+	case expfmt.TypeTextPlain:
+		format = "text"
+	case expfmt.TypeOpenMetrics:
+		format = "openmetrics"
+	case expfmt.TypeProtoDelim, expfmt.TypeProtoText, expfmt.TypeProtoCompact:
+		format = "protobuf"
+	default:
+		return
+	}
+
+	f.Header().Set(formatHeader, format)
+}
+
+// verify compares the provided credentials without leaking timing information about the username.
+func (b *BasicAuth) verify(username, password string) bool {
+	usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(b.Username)) == 1
+
+	var passwordOk bool
+	if b.PasswordHash != "" {
+		passwordOk = bcrypt.CompareHashAndPassword([]byte(b.PasswordHash), []byte(password)) == nil
+	} else {
+		passwordOk = subtle.ConstantTimeCompare([]byte(password), []byte(b.Password)) == 1
+	}
+
+	return usernameOk && passwordOk
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_BasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		cfg      *BasicAuth
+		username string
+		password string
+		setAuth  bool
+		want     int
+	}{
+		{"no header", &BasicAuth{Username: "user", Password: "secret"}, "", "", false, http.StatusUnauthorized},
+		{"plain ok", &BasicAuth{Username: "user", Password: "secret"}, "user", "secret", true, http.StatusOK},
+		{"plain wrong password", &BasicAuth{Username: "user", Password: "secret"}, "user", "wrong", true, http.StatusUnauthorized},
+		{"plain wrong username", &BasicAuth{Username: "user", Password: "secret"}, "admin", "secret", true, http.StatusUnauthorized},
+		{"bcrypt ok", &BasicAuth{Username: "user", PasswordHash: string(hash)}, "user", "secret", true, http.StatusOK},
+		{"bcrypt wrong password", &BasicAuth{Username: "user", PasswordHash: string(hash)}, "user", "wrong", true, http.StatusUnauthorized},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.setAuth {
+				req.SetBasicAuth(test.username, test.password)
+			}
+
+			rec := httptest.NewRecorder()
+			basicAuth(next, test.cfg).ServeHTTP(rec, req)
+
+			assert.Equal(t, test.want, rec.Code)
+			if test.want == http.StatusUnauthorized {
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func Test_Middleware_ServerHeader(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	assert.Empty(t, scrape(p.handler(), nil).Header().Get("Server"))
+
+	p.cfg.ServerHeader = "metrics"
+	assert.Equal(t, "metrics", scrape(p.handler(), nil).Header().Get("Server"))
+
+	// the rejected requests carry it as well
+	p.cfg.BasicAuth = &BasicAuth{Username: "user", Password: "secret"}
+	rec := scrape(p.handler(), nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "metrics", rec.Header().Get("Server"))
+
+	assert.Error(t, (&Config{ServerHeader: "metrics\r\nX-Injected: 1"}).validate())
+}
+
+func Test_Middleware_Allowlist(t *testing.T) {
+	p := newTestPlugin(&Config{AllowedCIDRs: []string{"10.0.0.0/8", "::1/128"}})
+	require.NoError(t, p.cfg.validate())
+
+	var err error
+	p.allowedNets, err = parseCIDRs("allowed_cidrs", p.cfg.AllowedCIDRs)
+	require.NoError(t, err)
+
+	get := func(remoteAddr string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = remoteAddr
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		rec := httptest.NewRecorder()
+		p.handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("10.1.2.3:51234", nil))
+	assert.Equal(t, http.StatusOK, get("[::1]:51234", nil))
+	assert.Equal(t, http.StatusForbidden, get("192.168.1.1:51234", nil))
+	// the forwarded address is not trusted
+	assert.Equal(t, http.StatusForbidden, get("192.168.1.1:51234", http.Header{"X-Forwarded-For": {"10.1.2.3"}}))
+	// unix socket peers have no address
+	assert.Equal(t, http.StatusForbidden, get("@", nil))
+
+	assert.Error(t, (&Config{AllowedCIDRs: []string{"10.0.0.0"}}).validate())
+}
+
+func Test_Middleware_ClientIP(t *testing.T) {
+	proxies, err := parseCIDRs("trusted_proxies", []string{"10.0.0.0/24"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Add("X-Forwarded-For", "10.9.9.9, 192.168.1.1")
+
+	assert.Equal(t, "10.0.0.1", clientIP(req, nil).String())
+	// the spoofed leftmost hop is ignored
+	assert.Equal(t, "192.168.1.1", clientIP(req, proxies).String())
+
+	req.Header.Add("X-Forwarded-For", "172.16.0.1")
+	assert.Equal(t, "172.16.0.1", clientIP(req, proxies).String())
+
+	// the hops of the chained trusted proxies are skipped
+	req.Header.Set("X-Forwarded-For", "10.9.9.9, 192.168.1.1, 10.0.0.2")
+	assert.Equal(t, "192.168.1.1", clientIP(req, proxies).String())
+
+	req.Header.Set("X-Forwarded-For", "10.9.9.9, garbage")
+	assert.Nil(t, clientIP(req, proxies))
+
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.1", clientIP(req, proxies).String())
+
+	// the header of a peer which is not a trusted proxy is ignored
+	req.RemoteAddr = "192.168.5.5:51234"
+	req.Header.Set("X-Forwarded-For", "10.9.9.9")
+	assert.Equal(t, "192.168.5.5", clientIP(req, proxies).String())
+
+	nets, err := parseCIDRs("allowed_cidrs", []string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	h := allowlist(http.NotFoundHandler(), nets, proxies)
+
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "10.9.9.9, 192.168.1.1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// a client can't spoof its way past the allowlist
+	req.RemoteAddr = "192.168.5.5:51234"
+	req.Header.Set("X-Forwarded-For", "10.9.9.9")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	assert.ErrorContains(t, (&Config{TrustProxy: true}).validate(), "trusted_proxies")
+	assert.ErrorContains(t, (&Config{TrustProxy: true, TrustedProxies: []string{"10.0.0.1"}}).validate(), "trusted_proxies")
+	assert.NoError(t, (&Config{TrustProxy: true, TrustedProxies: []string{"10.0.0.0/24"}}).validate())
+}
+
+func Test_Middleware_AccessLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+
+	p := newTestPlugin(&Config{LogRequests: true})
+	p.log = zap.New(core)
+
+	rec := scrape(p.handler(), nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	entries := logs.FilterMessage("scrape request").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "/metrics", fields["path"])
+	assert.Equal(t, int64(http.StatusOK), fields["status"])
+	assert.Equal(t, int64(rec.Body.Len()), fields["bytes"])
+	assert.Equal(t, "192.0.2.1", fields["client"])
+
+	p.cfg.LogRequests = false
+	scrape(p.handler(), nil)
+	assert.Equal(t, 1, logs.FilterMessage("scrape request").Len())
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.uber.org/zap"
+)
+
+const (
+	// OTLPProtocolGRPC exports the metrics using OTLP over gRPC.
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP exports the metrics using OTLP over HTTP (protobuf).
+	OTLPProtocolHTTP = "http"
+)
+
+// otlp periodically bridges the gathered metrics into the OpenTelemetry SDK and exports them to the OTLP endpoint.
+type otlp struct {
+	log      *zap.Logger
+	provider *sdkmetric.MeterProvider
+}
+
+func newOTLP(ctx context.Context, cfg *OTLP, g prometheus.Gatherer, log *zap.Logger) (*otlp, error) {
+	exporter, err := newOTLPExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("otlp: %w", err)
+	}
+
+	// the exporter is started by the reader, the first export happens after the interval
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(cfg.Interval),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(g))),
+	)
+
+	return &otlp{
+		log:      log,
+		provider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	}, nil
+}
+
+func newOTLPExporter(ctx context.Context, cfg *OTLP) (sdkmetric.Exporter, error) {
+	switch cfg.Protocol {
+	case OTLPProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(cfg.Endpoint), otlpmetrichttp.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.Endpoint), otlpmetricgrpc.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+
+		return otlpmetricgrpc.New(ctx, opts...)
+	}
+}
+
+// stop the periodic exports, the final state of the metrics is exported before the exporter is shut down.
+func (o *otlp) stop(ctx context.Context) {
+	err := o.provider.Shutdown(ctx)
+	if err != nil {
+		o.log.Error("failed to export final metrics to the otlp endpoint", zap.Error(err))
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_OTLP(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."})
+	registry.MustRegister(counter)
+	counter.Inc()
+
+	cfg := &OTLP{
+		Endpoint: strings.TrimPrefix(srv.URL, "http://"),
+		Protocol: OTLPProtocolHTTP,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+		Interval: time.Hour,
+		Insecure: true,
+	}
+
+	o, err := newOTLP(context.Background(), cfg, registry, zap.NewNop())
+	require.NoError(t, err)
+
+	// the final state is exported on stop
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	o.stop(ctx)
+
+	select {
+	case r := <-requests:
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	default:
+		t.Fatal("no metrics were exported")
+	}
+
+	c := &Config{OTLP: &OTLP{Endpoint: "localhost:4317", Protocol: "udp"}}
+	assert.ErrorContains(t, c.validate(), "otlp")
+}
@@ -2,45 +2,278 @@ package metrics
 
 import (
 	"context"
-	"crypto/tls"
 	stderr "errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"slices"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/roadrunner-server/endure/v2/dep"
 	"github.com/roadrunner-server/errors"
 	"go.uber.org/zap"
-	"golang.org/x/sys/cpu"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
 	// PluginName declares plugin name.
 	PluginName = "metrics"
-	// maxHeaderSize declares max header size for prometheus server
+	// maxHeaderSize declares the default max header size for prometheus server
 	maxHeaderSize = 1 << 20 // 1MB
 )
 
 // Plugin to manage application metrics using Prometheus.
 type Plugin struct {
 	cfg        *Config
+	cfgr       Configurer
 	log        *zap.Logger
 	mu         sync.Mutex // all receivers are pointers
-	http       *http.Server
+	servers    []*http.Server
 	collectors sync.Map // name -> collector
+	registries sync.Map // name -> subRegistry
+	addrs      sync.Map // configured address -> bound net.Addr
 	registry   *prometheus.Registry
+	// registerer attaches the global labels to every collector registered in the registry
+	registerer  prometheus.Registerer
+	pushgateway *pushgateway
+	remoteWrite *remoteWrite
+	otlp        *otlp
+	statsd      *statsd
+	series      *seriesCounter
+	selfMetrics *selfMetrics
+	// allowedNets are the parsed allowed_cidrs
+	allowedNets []*net.IPNet
+	// trustedProxies are the parsed trusted_proxies, nil unless trust_proxy is set
+	trustedProxies []*net.IPNet
+	// relabelConflicts are the sources of the relabel rules skipped on a name conflict, each is logged once
+	relabelConflicts sync.Map
 
 	// prometheus Collectors
 	statProviders []StatProvider
+	// collectors registered from the statProviders, unregistered on Stop
+	providerCollectors []prometheus.Collector
+	// prometheus Gatherers merged with the registry at scrape time
+	gathererProviders []GathererProvider
+	// stat providers refreshed right before the gather
+	refreshers []*refresher
 }
 
 // collector used to deduplicate registration
 type collector struct {
 	col        prometheus.Collector
 	registered bool
+	// def is the definition the collector was created from
+	def Collector
+	// fromConfig marks the collectors of the collect section, only they are changed on Reload
+	fromConfig bool
+	// registry is the name of the registry the collector is declared in, empty for the root one
+	registry string
+	// owner is the worker which declared the collector via RPC, optional
+	owner string
+	// redactLabels omits the label values from the errors, see log_labels
+	redactLabels bool
+	// disabled are the names of the families skipped in the exposition, nil when enabled, see SetEnabled
+	disabled atomic.Pointer[[]string]
+	// ttl expires the stale series, nil when the TTL is not set
+	ttl *seriesTTL
+	// enumMu serializes the state transitions of the enum gauge, so the concurrent ones can't leave two active states
+	enumMu sync.Mutex
+
+	// mu guards series, the distinct series of the vector collector tracked when max_cardinality is set
+	mu     sync.Mutex
+	series map[string]struct{}
+	// highCardinality is notified once the number of series reaches warnAt, optional
+	highCardinality func(series int)
+	warnAt          int
+	warned          bool
+}
+
+// wrapCollector wraps the prometheus collector created from the definition with the plugin bookkeeping.
+func wrapCollector(promCol prometheus.Collector, m *Collector, registered bool) *collector {
+	c := &collector{
+		col:        promCol,
+		registered: registered,
+		def:        *m,
+		ttl:        newSeriesTTL(promCol, m),
+	}
+
+	if m.MaxCardinality > 0 {
+		c.series = make(map[string]struct{})
+		if c.ttl != nil {
+			c.ttl.deleted = c.forget
+		}
+	}
+
+	c.initialize()
+	return c
+}
+
+// initialize applies the initial value, so the collector does not report 0 until the first update. The initial
+// values are validated along with the definition.
+func (c *collector) initialize() {
+	switch col := c.col.(type) {
+	case prometheus.Gauge:
+		col.Set(c.def.InitialValue)
+	case prometheus.Counter:
+		col.Add(c.def.InitialValue)
+	case *prometheus.GaugeVec:
+		for _, values := range c.def.InitialLabels {
+			_, _ = c.admit(values)
+			col.WithLabelValues(values...).Set(c.def.InitialValue)
+		}
+	case *prometheus.CounterVec:
+		for _, values := range c.def.InitialLabels {
+			_, _ = c.admit(values)
+			col.WithLabelValues(values...).Add(c.def.InitialValue)
+		}
+	default:
+		return
+	}
+
+	if c.ttl != nil {
+		for _, values := range c.def.InitialLabels {
+			c.ttl.touch(values)
+		}
+	}
+}
+
+// admit accounts the series against max_cardinality, a new series beyond the limit is rejected. Returns whether
+// the series is new, so the caller is able to forget it when prometheus rejects the label values.
+func (c *collector) admit(values []string) (bool, error) {
+	if c.series == nil {
+		return false, nil
+	}
+
+	key := seriesKey(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.series[key]; ok {
+		return false, nil
+	}
+
+	if len(c.series) >= c.def.MaxCardinality {
+		return false, fmt.Errorf("max_cardinality %d of the collector is reached, series %s rejected", c.def.MaxCardinality, c.describe(values))
+	}
+
+	c.series[key] = struct{}{}
+	if c.highCardinality != nil && !c.warned && len(c.series) >= c.warnAt {
+		c.warned = true
+		c.highCardinality(len(c.series))
+	}
+
+	return true, nil
+}
+
+// watchCardinality reports the collector crossing the cardinality_warning_ratio of its max_cardinality.
+func (p *Plugin) watchCardinality(name string, c *collector) {
+	if c.series == nil {
+		return
+	}
+
+	c.warnAt = max(int(math.Ceil(float64(c.def.MaxCardinality)*p.cfg.CardinalityWarningRatio)), 1)
+	c.highCardinality = func(series int) {
+		p.selfMetrics.highCardinality.WithLabelValues(name).Inc()
+		p.log.Warn("collector is approaching its max_cardinality, check the label values for unbounded ones (e.g. request ids)",
+			zap.String("collector", name), zap.Int("series", series), zap.Int("max_cardinality", c.def.MaxCardinality))
+	}
+}
+
+// forget removes the deleted series from the cardinality accounting.
+func (c *collector) forget(values []string) {
+	if c.series == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.series, seriesKey(values))
+	c.mu.Unlock()
+}
+
+// touch records the update of the series for the TTL bookkeeping.
+func (c *collector) touch(m *Metric) {
+	if c.ttl == nil {
+		return
+	}
+
+	if values := c.labelValues(m); len(values) > 0 {
+		c.ttl.touch(values)
+	}
+}
+
+// fqName returns the fully qualified name of the collector as exposed to the scrapers.
+func (p *Plugin) fqName(name string, c *collector) string {
+	if p.cfg.SanitizeNames {
+		name = sanitizeMetricName(name)
+	}
+
+	return prometheus.BuildFQName(c.def.Namespace, c.def.Subsystem, name)
+}
+
+// familyNames returns the names of the metric families exposed by the collector, including the histogram mirror.
+func (p *Plugin) familyNames(name string, c *collector) []string {
+	names := []string{p.fqName(name, c)}
+	if c.def.MirrorAsHistogram != nil {
+		names = append(names, p.fqName(name+c.def.MirrorAsHistogram.suffix(), c))
+	}
+
+	return names
+}
+
+// describe formats the label values for the errors, only their number when the values are redacted.
+func (c *collector) describe(values []string) string {
+	if c.redactLabels {
+		return fmt.Sprintf("[%d redacted values]", len(values))
+	}
+
+	return fmt.Sprint(values)
+}
+
+// matchLabelMap rejects the label map whose keys differ from the declared labels, a missing label would otherwise
+// silently become an empty value of a wrong series.
+func (c *collector) matchLabelMap(m *Metric) error {
+	if len(m.LabelMap) == 0 {
+		return nil
+	}
+
+	if len(m.LabelMap) != len(c.def.Labels) || slices.ContainsFunc(c.def.Labels, func(name string) bool {
+		_, ok := m.LabelMap[name]
+		return !ok
+	}) {
+		return withCode(CodeInvalidLabels, errors.Errorf("label map %v of collector %s should have exactly the labels %v",
+			slices.Sorted(maps.Keys(m.LabelMap)), m.Name, c.def.Labels))
+	}
+
+	return nil
+}
+
+// labelValues returns the label values of the metric in the declared order.
+func (c *collector) labelValues(m *Metric) []string {
+	if len(m.LabelMap) == 0 {
+		return m.Labels
+	}
+
+	values := make([]string, 0, len(c.def.Labels))
+	for _, name := range c.def.Labels {
+		values = append(values, m.LabelMap[name])
+	}
+
+	return values
+}
+
+// release stops the background work of the collector, should be called once it is removed.
+func (c *collector) release() {
+	if c.ttl != nil {
+		c.ttl.stop()
+	}
 }
 
 type Configurer interface {
@@ -54,11 +287,28 @@ type Logger interface {
 	NamedLogger(name string) *zap.Logger
 }
 
+// Registerer is satisfied by the plugin, so other plugins can (un)register their collectors directly
+// instead of providing them via the StatProvider.
+type Registerer interface {
+	// Register the collector, the global labels are attached to its metrics.
+	Register(c prometheus.Collector) error
+	// Unregister the collector, returns whether it was registered.
+	Unregister(c prometheus.Collector) bool
+}
+
+var _ Registerer = (*Plugin)(nil)
+
 // StatProvider used to collect all plugins which might report to the prometheus
 type StatProvider interface {
 	MetricsCollector() []prometheus.Collector
 }
 
+// GathererProvider used to collect all plugins which own a complete gatherer (e.g. a sub-registry).
+// The gathered metrics are merged with the plugin registry as is, the global labels are not attached to them.
+type GathererProvider interface {
+	MetricsGatherer() prometheus.Gatherer
+}
+
 // Init service.
 func (p *Plugin) Init(cfg Configurer, log Logger) error {
 	const op = errors.Op("metrics_plugin_init")
@@ -70,24 +320,82 @@ func (p *Plugin) Init(cfg Configurer, log Logger) error {
 	if err != nil {
 		return errors.E(op, errors.Disabled, err)
 	}
+	p.cfgr = cfg
+
+	err = p.cfg.Validate()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	p.allowedNets, err = parseCIDRs("allowed_cidrs", p.cfg.AllowedCIDRs)
+	if err != nil {
+		return errors.E(op, err)
+	}
 
-	p.cfg.InitDefaults()
+	p.trustedProxies, err = p.cfg.trustedProxies()
+	if err != nil {
+		return errors.E(op, err)
+	}
 
 	p.log = log.NamedLogger(PluginName)
 	p.registry = prometheus.NewRegistry()
+	p.registerer = p.registry
+	if len(p.cfg.Labels) != 0 {
+		p.registerer = prometheus.WrapRegistererWith(p.cfg.Labels, p.registry)
+	}
 
 	// Default
-	err = p.registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	err = p.safeRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	if err != nil {
 		return errors.E(op, err)
 	}
 
 	// Default
-	err = p.registry.Register(collectors.NewGoCollector())
+	goCollector, err := newGoCollector(p.cfg.GoCollector)
 	if err != nil {
 		return errors.E(op, err)
 	}
 
+	err = p.safeRegister(goCollector)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if p.cfg.EnableOpenMetrics && len(p.cfg.Labels) != 0 {
+		ti, err := newTargetInfo(p.cfg.Labels)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		// the registry is used directly, target_info carries the global labels already
+		err = safeRegister(p.registry, ti)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if p.cfg.StatsD != nil {
+		p.statsd, err = newStatsD(p.cfg.StatsD, p.log)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	p.selfMetrics = newSelfMetrics()
+	for _, c := range p.selfMetrics.collectors() {
+		err = p.safeRegister(c)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if p.cfg.SeriesInterval > 0 {
+		err = p.safeRegister(p.selfMetrics.series)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
 	cl, err := p.cfg.getCollectors()
 	if err != nil {
 		return errors.E(op, err)
@@ -95,36 +403,185 @@ func (p *Plugin) Init(cfg Configurer, log Logger) error {
 
 	// Register invocation will be later in the Serve method
 	for k, v := range cl {
+		if name := sanitizeMetricName(k); p.cfg.SanitizeNames && name != k {
+			p.log.Debug("collector name was sanitized", zap.String("name", k), zap.String("sanitized", name))
+		}
+
+		p.watchCardinality(k, v)
 		p.collectors.Store(k, v)
 	}
 
+	p.updateCollectorsCount()
+
 	p.statProviders = make([]StatProvider, 0, 2)
+	p.gathererProviders = make([]GathererProvider, 0, 1)
+	p.refreshers = nil
 
 	return nil
 }
 
+// updateCollectorsCount recomputes the number of collectors, should be called after every change of p.collectors under p.mu.
+func (p *Plugin) updateCollectorsCount() {
+	var n int
+	p.collectors.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+
+	p.selfMetrics.registeredCollectors.Set(float64(n))
+}
+
+// gatherer merges the registry with the gatherers of the GathererProvider plugins and the named registries.
+// The named registries come and go at runtime, so the union is built on every gather. The MetricsRefresher providers
+// are refreshed before it.
+func (p *Plugin) gatherer() prometheus.Gatherer {
+	return p.decorate(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		p.refresh()
+
+		gs := make(prometheus.Gatherers, 0, len(p.gathererProviders)+1)
+		gs = append(gs, p.registry)
+		for _, gp := range p.gathererProviders {
+			gs = append(gs, gp.MetricsGatherer())
+		}
+		gs = append(gs, p.gatherRegistries()...)
+
+		if len(gs) == 1 {
+			return p.registry.Gather()
+		}
+
+		return gs.Gather()
+	}))
+}
+
+// decorate skips the disabled collectors and applies the relabel rules and the sample timestamps to the gatherer.
+func (p *Plugin) decorate(g prometheus.Gatherer) prometheus.Gatherer {
+	// the disabled collectors are matched by their original names, so before the relabeling
+	g = p.withoutDisabled(g)
+	g = relabel(g, p.cfg.Relabel, p.relabelConflict)
+	if p.cfg.TimestampSamples {
+		// explicit timestamps change the scrape semantics (e.g. staleness), so they are opt-in
+		g = timestamped(g)
+	}
+
+	return g
+}
+
+// relabelConflict logs the relabel rule skipped because its target is taken, once per rule.
+func (p *Plugin) relabelConflict(r Relabel) {
+	if _, loaded := p.relabelConflicts.LoadOrStore(r.Source, struct{}{}); loaded {
+		return
+	}
+
+	p.log.Warn("relabel rule skipped, the target already exists", zap.String("source", r.Source), zap.String("target", r.Target))
+}
+
+// registerStatProviders registers the collectors of the StatProvider plugins. A failing collector is skipped,
+// so a single misbehaving plugin does not disable the metrics of the others.
+func (p *Plugin) registerStatProviders() {
+	var errs []error
+	for _, sp := range p.statProviders {
+		for _, c := range sp.MetricsCollector() {
+			err := p.safeRegister(c)
+			if err == nil {
+				p.providerCollectors = append(p.providerCollectors, c)
+				continue
+			}
+
+			var are prometheus.AlreadyRegisteredError
+			if stderr.As(err, &are) {
+				// plugins sharing a library often return the same collector instance, it is already exposed
+				if are.ExistingCollector == c {
+					p.log.Debug("stat provider collector is already registered",
+						zap.String("provider", providerName(sp)), zap.String("collector", fmt.Sprintf("%T", c)))
+					continue
+				}
+
+				// a different instance with the same descriptors can't be exposed, its updates are lost
+				p.log.Warn("stat provider collector duplicates an already registered one and is not exposed",
+					zap.String("provider", providerName(sp)), zap.String("collector", fmt.Sprintf("%T", c)))
+				continue
+			}
+
+			p.log.Debug("failed to register stat provider collector, skipping", zap.String("provider", providerName(sp)), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", providerName(sp), err))
+		}
+	}
+
+	if len(errs) > 0 {
+		p.log.Warn("some stat provider collectors were not registered", zap.Int("failed", len(errs)), zap.Error(stderr.Join(errs...)))
+	}
+}
+
+// providerName returns the plugin name of the provider, or its type when the provider is not named.
+func providerName(provider any) string {
+	if n, ok := provider.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+
+	return fmt.Sprintf("%T", provider)
+}
+
+// mirror the RPC operation to StatsD when enabled.
+func (p *Plugin) mirror(col *collector, m *Metric, op statsdOp, value float64) {
+	if p.statsd != nil {
+		p.statsd.mirror(col, m, op, value)
+	}
+}
+
+// mirrorBulk mirrors the bulk observations to StatsD when enabled.
+func (p *Plugin) mirrorBulk(col *collector, m *Metric, observations []Observation) {
+	if p.statsd != nil {
+		p.statsd.mirrorBulk(col, m, observations)
+	}
+}
+
 // Register new prometheus collector.
 func (p *Plugin) Register(c prometheus.Collector) error {
-	return p.registry.Register(c)
+	return p.safeRegister(c)
+}
+
+// safeRegister is the single registration path of the plugin (Init, Serve, Declare and Register). A panicking registerer
+// is converted to an error instead of crashing the process. The registry errors are returned as is, so the callers are
+// able to assert prometheus.AlreadyRegisteredError and reuse the existing collector, as documented by client_golang.
+func (p *Plugin) safeRegister(c prometheus.Collector) error {
+	err := safeRegister(p.registerer, c)
+	if _, ok := err.(prometheus.AlreadyRegisteredError); ok { //nolint:errorlint
+		p.log.Debug("collector is already registered", zap.String("collector", fmt.Sprintf("%T", c)))
+	}
+
+	return err
+}
+
+func safeRegister(reg prometheus.Registerer, c prometheus.Collector) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("failed to register collector %T: %v", c, rec)
+		}
+	}()
+
+	return reg.Register(c)
+}
+
+// Unregister prometheus collector.
+func (p *Plugin) Unregister(c prometheus.Collector) bool {
+	return p.UnregisterCollector(c)
+}
+
+// UnregisterCollector unregisters the collector registered directly via Register, complementing the name-based
+// Unregister RPC. The registerer is used, so the collectors wrapped with the global labels are found as well.
+func (p *Plugin) UnregisterCollector(c prometheus.Collector) bool {
+	return p.registerer.Unregister(c)
 }
 
 // Serve prometheus metrics service.
 func (p *Plugin) Serve() chan error { //nolint:gocyclo
-	errCh := make(chan error, 1)
+	// every listener should be able to report its failure without blocking
+	errCh := make(chan error, len(p.cfg.Addresses)+1)
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	// register Collected stat providers
-	for i := 0; i < len(p.statProviders); i++ {
-		sp := p.statProviders[i]
-		for _, c := range sp.MetricsCollector() {
-			err := p.registry.Register(c)
-			if err != nil {
-				errCh <- err
-				return errCh
-			}
-		}
-	}
+	p.registerStatProviders()
 
 	// range over the collectors registered via configuration
 	p.collectors.Range(func(_, value any) bool {
@@ -137,112 +594,177 @@ func (p *Plugin) Serve() chan error { //nolint:gocyclo
 			return true
 		}
 
-		if err := p.registry.Register(c.col); err != nil {
+		if err := p.safeRegister(c.col); err != nil {
 			errCh <- err
 			return false
 		}
 
+		c.registered = true
+		if c.ttl != nil {
+			c.ttl.start()
+		}
 		return true
 	})
 
-	var topCipherSuites []uint16
-	var defaultCipherSuitesTLS13 []uint16
-
-	hasGCMAsmAMD64 := cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
-	hasGCMAsmARM64 := cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
-	// Keep in sync with crypto/aes/cipher_s390x.go.
-	hasGCMAsmS390X := cpu.S390X.HasAES && cpu.S390X.HasAESCBC && cpu.S390X.HasAESCTR && (cpu.S390X.HasGHASH || cpu.S390X.HasAESGCM)
-
-	hasGCMAsm := hasGCMAsmAMD64 || hasGCMAsmARM64 || hasGCMAsmS390X
-
-	if hasGCMAsm {
-		// If AES-GCM hardware is provided, then prioritize AES-GCM
-		// cipher suites.
-		topCipherSuites = []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	// all listeners share the same handler and therefore the same registry
+	handler := p.handler()
+	tlsConfig := p.tlsConfig()
+
+	var h2s *http2.Server
+	if p.cfg.HTTP2 != nil {
+		h2s = &http2.Server{
+			MaxConcurrentStreams: p.cfg.HTTP2.MaxConcurrentStreams,
+			IdleTimeout:          p.cfg.Timeouts.Idle,
 		}
-		defaultCipherSuitesTLS13 = []uint16{
-			tls.TLS_AES_128_GCM_SHA256,
-			tls.TLS_CHACHA20_POLY1305_SHA256,
-			tls.TLS_AES_256_GCM_SHA384,
+
+		if p.cfg.HTTP2.H2C {
+			// the cleartext HTTP/2 connections are not encrypted, for the trusted networks only
+			handler = h2c.NewHandler(handler, h2s)
 		}
-	} else {
-		// Without AES-GCM hardware, we put the ChaCha20-Poly1305
-		// cipher suites first.
-		topCipherSuites = []uint16{
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+
+	p.servers = make([]*http.Server, 0, len(p.cfg.Addresses))
+	for _, addr := range p.cfg.Addresses {
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			IdleTimeout:       p.cfg.Timeouts.Idle,
+			ReadTimeout:       p.cfg.Timeouts.Read,
+			MaxHeaderBytes:    p.cfg.MaxHeaderBytes,
+			ReadHeaderTimeout: p.cfg.Timeouts.ReadHeader,
+			WriteTimeout:      p.cfg.Timeouts.Write,
+			TLSConfig:         tlsConfig.Clone(),
 		}
-		defaultCipherSuitesTLS13 = []uint16{
-			tls.TLS_CHACHA20_POLY1305_SHA256,
-			tls.TLS_AES_128_GCM_SHA256,
-			tls.TLS_AES_256_GCM_SHA384,
+
+		if h2s != nil {
+			// advertises h2 via ALPN explicitly
+			err := http2.ConfigureServer(srv, h2s)
+			if err != nil {
+				errCh <- errors.Errorf("metrics server %s: %v", addr, err)
+				return errCh
+			}
 		}
+
+		p.servers = append(p.servers, srv)
+	}
+
+	if p.cfg.Pushgateway != nil {
+		p.pushgateway = newPushgateway(p.cfg.Pushgateway, p.gatherer(), p.log)
+		p.pushgateway.start()
+	}
+
+	if p.cfg.RemoteWrite != nil {
+		p.remoteWrite = newRemoteWrite(p.cfg.RemoteWrite, p.gatherer(), p.log)
+		p.remoteWrite.start()
 	}
 
-	DefaultCipherSuites := make([]uint16, 0, 22)
-	DefaultCipherSuites = append(DefaultCipherSuites, topCipherSuites...)
-	DefaultCipherSuites = append(DefaultCipherSuites, defaultCipherSuitesTLS13...)
-
-	p.http = &http.Server{
-		Addr:              p.cfg.Address,
-		Handler:           promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}),
-		IdleTimeout:       time.Hour,
-		ReadTimeout:       time.Minute * 2,
-		MaxHeaderBytes:    maxHeaderSize,
-		ReadHeaderTimeout: time.Minute * 2,
-		WriteTimeout:      time.Minute * 2,
-		TLSConfig: &tls.Config{
-			CurvePreferences: []tls.CurveID{
-				tls.X25519,
-				tls.CurveP256,
-				tls.CurveP384,
-				tls.CurveP521,
-			},
-			CipherSuites: DefaultCipherSuites,
-			MinVersion:   tls.VersionTLS12,
-		},
-	}
-
-	go func() {
-		err := p.http.ListenAndServe()
-		if err != nil && !stderr.Is(err, http.ErrServerClosed) {
+	if p.statsd != nil {
+		p.statsd.start()
+	}
+
+	if p.cfg.SeriesInterval > 0 {
+		p.series = newSeriesCounter(p.cfg.SeriesInterval, p.gatherer(), p.selfMetrics.series, p.log)
+		p.series.start()
+	}
+
+	if p.cfg.OTLP != nil {
+		o, err := newOTLP(context.Background(), p.cfg.OTLP, p.gatherer(), p.log)
+		if err != nil {
 			errCh <- err
-			return
+			return errCh
 		}
-	}()
+
+		p.otlp = o
+	}
+
+	for _, srv := range p.servers {
+		go func() {
+			err := p.serve(srv)
+			if err != nil && !stderr.Is(err, http.ErrServerClosed) {
+				errCh <- errors.Errorf("metrics server %s: %v", srv.Addr, err)
+				return
+			}
+		}()
+	}
 
 	return errCh
 }
 
+// Addr returns the bound address of the first configured address, e.g. the port chosen for 127.0.0.1:0.
+// Nil until the server is listening.
+func (p *Plugin) Addr() net.Addr {
+	if len(p.cfg.Addresses) == 0 {
+		return nil
+	}
+
+	if a, ok := p.addrs.Load(p.cfg.Addresses[0]); ok {
+		return a.(net.Addr)
+	}
+
+	return nil
+}
+
 func (p *Plugin) Weight() uint {
 	return 1
 }
 
 // Stop prometheus metrics service.
-func (p *Plugin) Stop(context.Context) error {
+func (p *Plugin) Stop(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.http != nil {
-		// timeout is 10 seconds
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	// the deadline of the caller takes precedence, the configured timeout only bounds the shutdown without one
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.ShutdownTimeout)
 		defer cancel()
-		err := p.http.Shutdown(ctx)
+	}
+
+	for _, srv := range p.servers {
+		err := srv.Shutdown(ctx)
 		if err != nil {
 			// Function should be Stop() error
-			p.log.Error("stop error", zap.Error(errors.Errorf("error shutting down the metrics server: error %v", err)))
+			p.log.Error("stop error", zap.String("address", srv.Addr), zap.Error(errors.Errorf("error shutting down the metrics server: error %v", err)))
+		}
+
+		p.addrs.Delete(srv.Addr)
+		err = removeSocket(srv.Addr)
+		if err != nil {
+			p.log.Warn("failed to remove the metrics socket", zap.String("address", srv.Addr), zap.Error(err))
 		}
 	}
+
+	p.collectors.Range(func(_, value any) bool {
+		value.(*collector).release()
+		return true
+	})
+
+	// providers might be restarted without the metrics plugin, their collectors would be registered again
+	for _, c := range p.providerCollectors {
+		p.registerer.Unregister(c)
+	}
+	p.providerCollectors = nil
+
+	if p.pushgateway != nil {
+		p.pushgateway.stop(ctx)
+	}
+
+	if p.remoteWrite != nil {
+		p.remoteWrite.stop(ctx)
+	}
+
+	if p.otlp != nil {
+		p.otlp.stop(ctx)
+	}
+
+	if p.statsd != nil {
+		p.statsd.stop()
+	}
+
+	if p.series != nil {
+		p.series.stop()
+	}
+
 	return nil
 }
 
@@ -252,7 +774,14 @@ func (p *Plugin) Collects() []*dep.In {
 		dep.Fits(func(pp any) {
 			sp := pp.(StatProvider)
 			p.statProviders = append(p.statProviders, sp)
+			if r, ok := sp.(MetricsRefresher); ok {
+				p.refreshers = append(p.refreshers, &refresher{r: r})
+			}
 		}, (*StatProvider)(nil)),
+		dep.Fits(func(pp any) {
+			gp := pp.(GathererProvider)
+			p.gathererProviders = append(p.gathererProviders, gp)
+		}, (*GathererProvider)(nil)),
 	}
 }
 
@@ -0,0 +1,418 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
+)
+
+type testStatProvider struct {
+	collectors []prometheus.Collector
+}
+
+func (sp *testStatProvider) MetricsCollector() []prometheus.Collector {
+	return sp.collectors
+}
+
+func Test_Plugin_StatProviderFailure(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	p.statProviders = []StatProvider{
+		&testStatProvider{collectors: []prometheus.Collector{
+			prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."}),
+		}},
+		// conflicts with the first provider, the rest of its collectors are still registered
+		&testStatProvider{collectors: []prometheus.Collector{
+			prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Other jobs."}),
+			prometheus.NewCounter(prometheus.CounterOpts{Name: "tasks_total", Help: "Tasks."}),
+		}},
+	}
+
+	p.registerStatProviders()
+
+	families, err := p.registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 2)
+	assert.Equal(t, "jobs_total", families[0].GetName())
+	assert.Equal(t, "Jobs.", families[0].GetHelp())
+	assert.Equal(t, "tasks_total", families[1].GetName())
+}
+
+func Test_Plugin_StatProviderDuplicate(t *testing.T) {
+	newCounter := func() prometheus.Collector {
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: "shared_total", Help: "Shared."})
+	}
+
+	core, logs := observer.New(zap.DebugLevel)
+	shared := newCounter()
+
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0"})
+	p.log = zap.New(core)
+	p.statProviders = []StatProvider{
+		&testStatProvider{collectors: []prometheus.Collector{shared}},
+		// the same instance, e.g. of the shared library
+		&testStatProvider{collectors: []prometheus.Collector{shared}},
+		// a different instance, its updates would be lost
+		&testStatProvider{collectors: []prometheus.Collector{newCounter()}},
+	}
+
+	errCh := p.Serve()
+	t.Cleanup(func() {
+		assert.NoError(t, p.Stop(context.Background()))
+	})
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected serve error: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	n, err := testutil.GatherAndCount(p.registry, "shared_total")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Equal(t, 1, logs.FilterMessage("stat provider collector is already registered").Len())
+	warns := logs.FilterMessage("stat provider collector duplicates an already registered one and is not exposed")
+	require.Equal(t, 1, warns.Len())
+	assert.Equal(t, zap.WarnLevel, warns.All()[0].Level)
+}
+
+func Test_Plugin_Registerer(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	var reg Registerer = p
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."})
+	require.NoError(t, reg.Register(c))
+	assert.Error(t, reg.Register(c))
+	assert.True(t, reg.Unregister(c))
+	assert.False(t, reg.Unregister(c))
+}
+
+func Test_Plugin_UnregisterCollector(t *testing.T) {
+	p := newTestPlugin(&Config{})
+	p.registerer = prometheus.WrapRegistererWith(prometheus.Labels{"app": "test"}, p.registry)
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."})
+	require.NoError(t, p.Register(c))
+	assert.True(t, p.UnregisterCollector(c))
+
+	n, err := testutil.GatherAndCount(p.registry, "jobs_total")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func Test_Plugin_StatProviderStop(t *testing.T) {
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0"})
+	p.statProviders = []StatProvider{
+		&testStatProvider{collectors: []prometheus.Collector{
+			prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."}),
+		}},
+	}
+
+	p.Serve()
+	require.NoError(t, p.Stop(context.Background()))
+
+	n, err := testutil.GatherAndCount(p.registry, "jobs_total")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Empty(t, p.providerCollectors)
+
+	// a restarted provider registers the same collector again
+	p.registerStatProviders()
+	n, err = testutil.GatherAndCount(p.registry, "jobs_total")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// panickingRegisterer mimics a registerer which panics on the broken collector instead of returning an error.
+type panickingRegisterer struct {
+	prometheus.Registerer
+	broken prometheus.Collector
+}
+
+func (r panickingRegisterer) Register(c prometheus.Collector) error {
+	if c == r.broken {
+		panic("register")
+	}
+
+	return r.Registerer.Register(c)
+}
+
+func Test_Plugin_SafeRegister(t *testing.T) {
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0"})
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."})
+	require.NoError(t, p.safeRegister(counter))
+
+	// the client_golang idiom asserts the error type directly
+	err := p.Register(prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."}))
+	are, ok := err.(prometheus.AlreadyRegisteredError) //nolint:errorlint
+	require.True(t, ok)
+	assert.Same(t, counter, are.ExistingCollector)
+
+	broken := prometheus.NewGauge(prometheus.GaugeOpts{Name: "broken", Help: "Broken."})
+	p.registerer = panickingRegisterer{Registerer: p.registry, broken: broken}
+
+	err = p.safeRegister(broken)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "register")
+
+	// the public Register goes through the same path
+	require.Error(t, p.Register(broken))
+
+	// Serve reports the failure instead of crashing
+	p.collectors.Store("broken", &collector{col: broken})
+	errCh := p.Serve()
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+
+	select {
+	case err = <-errCh:
+		assert.Contains(t, err.Error(), "register")
+	case <-time.After(time.Second):
+		t.Fatal("no error reported for the panicking registerer")
+	}
+}
+
+// testConfigurer serves the plugin configuration.
+type testConfigurer struct {
+	cfg *Config
+}
+
+func (c *testConfigurer) UnmarshalKey(_ string, out any) error {
+	*out.(*Config) = *c.cfg
+	return nil
+}
+
+func (c *testConfigurer) Has(string) bool {
+	return true
+}
+
+func Test_Plugin_Reload(t *testing.T) {
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0", Collect: map[string]Collector{
+		"removed":   {Type: Counter, Help: "Removed."},
+		"kept":      {Type: Counter, Help: "Kept."},
+		"changed":   {Type: Counter, Help: "Changed."},
+		"conflicts": {Type: Gauge, Help: "Conflicts."},
+	}})
+
+	cl, err := p.cfg.getCollectors()
+	require.NoError(t, err)
+	for name, col := range cl {
+		if name != "conflicts" {
+			p.collectors.Store(name, col)
+		}
+	}
+
+	r := &rpc{p: p, log: p.log}
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "conflicts", Collector: Collector{Type: Counter, Help: "Declared."}}, &ok))
+
+	p.Serve()
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+
+	require.NoError(t, r.Inc("kept", &ok))
+	require.NoError(t, r.Inc("changed", &ok))
+	kept, _ := p.collectors.Load("kept")
+
+	p.cfgr = &testConfigurer{cfg: &Config{Collect: map[string]Collector{
+		"kept":      {Type: Counter, Help: "Kept."},
+		"changed":   {Type: Gauge, Help: "Changed."},
+		"added":     {Type: Gauge, Help: "Added."},
+		"conflicts": {Type: Gauge, Help: "Conflicts."},
+	}}}
+
+	err = r.Reload(nil, &ok)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "conflicts: the name is taken by the collector declared via RPC")
+
+	_, exist := p.collectors.Load("removed")
+	assert.False(t, exist)
+
+	// the unchanged collector keeps its value
+	c, _ := p.collectors.Load("kept")
+	assert.Same(t, kept, c)
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.(*collector).col))
+
+	// the type change replaces the collector
+	c, _ = p.collectors.Load("changed")
+	assert.Equal(t, Gauge, c.(*collector).def.Type)
+	require.NoError(t, r.Set(&Metric{Name: "changed", Value: 5}, &ok))
+
+	c, _ = p.collectors.Load("conflicts")
+	assert.Equal(t, Counter, c.(*collector).def.Type)
+
+	n, err := testutil.GatherAndCount(p.registry, "removed", "kept", "changed", "added", "conflicts")
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// an invalid configuration changes nothing
+	p.cfgr = &testConfigurer{cfg: &Config{Collect: map[string]Collector{"kept": {Type: "unknown"}}}}
+	require.Error(t, r.Reload(nil, &ok))
+	_, exist = p.collectors.Load("added")
+	assert.True(t, exist)
+}
+
+func Test_Plugin_ReloadRequest(t *testing.T) {
+	cfg := &Config{Address: "127.0.0.1:0", Collect: map[string]Collector{
+		"kept":    {Type: Counter, Help: "Kept."},
+		"latency": {Type: Histogram, Help: "Latency.", Buckets: []float64{1}},
+	}}
+	p := newTestPlugin(cfg)
+
+	// the configurer keeps serving the configuration parsed on startup
+	served := *cfg
+	p.cfgr = &testConfigurer{cfg: &served}
+
+	cl, err := p.cfg.getCollectors()
+	require.NoError(t, err)
+	for name, col := range cl {
+		p.collectors.Store(name, col)
+	}
+
+	p.Serve()
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+
+	kept, _ := p.collectors.Load("kept")
+
+	// the section re-read by the worker from the changed configuration file
+	var req ReloadRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"collect": {
+			"kept": {"type": "counter", "help": "Kept."},
+			"latency": {"type": "histogram", "help": "Latency.", "buckets": [1, 5]}
+		},
+		"groups": {"jobs": {"namespace": "app", "collect": {"pushed_total": {"type": "counter", "help": "Pushed."}}}}
+	}`), &req))
+
+	r := &rpc{p: p, log: p.log}
+	var ok bool
+	require.NoError(t, r.Reload(&req, &ok))
+	assert.True(t, ok)
+
+	c, _ := p.collectors.Load("kept")
+	assert.Same(t, kept, c)
+
+	// the changed definition is applied
+	c, _ = p.collectors.Load("latency")
+	assert.Equal(t, []float64{1, 5}, c.(*collector).def.Buckets)
+	require.NoError(t, r.Observe(&Metric{Name: "latency", Value: 3}, &ok))
+
+	mfs, err := p.registry.Gather()
+	require.NoError(t, err)
+	names := make([]string, 0, len(mfs))
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+		if mf.GetName() == "latency" {
+			assert.Len(t, mf.GetMetric()[0].GetHistogram().GetBucket(), 2)
+		}
+	}
+	assert.Contains(t, names, "app_pushed_total")
+
+	// an empty request re-reads the unchanged configurer, restoring the startup section
+	require.NoError(t, r.Reload(&ReloadRequest{}, &ok))
+	c, _ = p.collectors.Load("latency")
+	assert.Equal(t, []float64{1}, c.(*collector).def.Buckets)
+
+	// an invalid section is rejected as a whole
+	err = r.Reload(&ReloadRequest{Collect: map[string]Collector{"kept": {Type: "unknown"}}}, &ok)
+	require.Error(t, err)
+	c, _ = p.collectors.Load("kept")
+	assert.Same(t, kept, c)
+}
+
+func Test_Plugin_H2C(t *testing.T) {
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0", HTTP2: &HTTP2{H2C: true}})
+	errCh := p.Serve()
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second*5, time.Millisecond*10)
+
+	// prior knowledge h2c, the TLS dial is replaced with the plain one
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	resp, err := client.Get("http://" + p.Addr().String() + "/metrics") //nolint:noctx
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected serve error: %v", err)
+	default:
+	}
+}
+
+type refreshingStatProvider struct {
+	gauge prometheus.Gauge
+	calls int
+	block chan struct{}
+	// blocked counts the refreshes stuck on the block
+	blocked atomic.Int32
+}
+
+func (sp *refreshingStatProvider) MetricsCollector() []prometheus.Collector {
+	return []prometheus.Collector{sp.gauge}
+}
+
+func (sp *refreshingStatProvider) RefreshMetrics() {
+	if sp.block != nil {
+		sp.blocked.Add(1)
+		<-sp.block
+		return
+	}
+
+	sp.calls++
+	sp.gauge.Set(float64(sp.calls))
+}
+
+func Test_Plugin_RefreshMetrics(t *testing.T) {
+	sp := &refreshingStatProvider{gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "workers", Help: "Workers."})}
+
+	p := newTestPlugin(&Config{})
+	p.Collects()[0].Callback(sp)
+	require.Len(t, p.refreshers, 1)
+	p.registerStatProviders()
+
+	for want := 1.0; want <= 2; want++ {
+		mfs, err := p.gatherer().Gather()
+		require.NoError(t, err)
+		require.Len(t, mfs, 1)
+		assert.Equal(t, want, mfs[0].GetMetric()[0].GetGauge().GetValue())
+	}
+
+	// a stuck refresher does not stall the gather for longer than the timeout
+	sp.block = make(chan struct{})
+	t.Cleanup(func() { close(sp.block) })
+
+	start := time.Now()
+	_, err := p.gatherer().Gather()
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), refreshTimeout*2)
+
+	// the unfinished refresher is skipped rather than called again
+	start = time.Now()
+	_, err = p.gatherer().Gather()
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), refreshTimeout)
+	assert.Equal(t, int32(1), sp.blocked.Load())
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+)
+
+const (
+	// PushModePush replaces all metrics of the job and grouping on the Pushgateway.
+	PushModePush string = "push"
+	// PushModeAdd merges the metrics with the ones already pushed for the job and grouping.
+	PushModeAdd string = "add"
+)
+
+// pushgateway periodically pushes the gathered metrics to the Prometheus Pushgateway.
+type pushgateway struct {
+	cfg    *Pushgateway
+	log    *zap.Logger
+	pusher *push.Pusher
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPushgateway(cfg *Pushgateway, g prometheus.Gatherer, log *zap.Logger) *pushgateway {
+	pusher := push.New(cfg.URL, cfg.Job).Gatherer(g)
+	for name, value := range cfg.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	if cfg.Username != "" {
+		pusher = pusher.BasicAuth(cfg.Username, cfg.Password)
+	}
+
+	return &pushgateway{
+		cfg:    cfg,
+		log:    log,
+		pusher: pusher,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// start pushing metrics in the background.
+func (pg *pushgateway) start() {
+	pg.wg.Add(1)
+	go func() {
+		defer pg.wg.Done()
+
+		ticker := time.NewTicker(pg.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), pg.cfg.Interval)
+				err := pg.push(ctx)
+				cancel()
+				if err != nil {
+					pg.log.Warn("failed to push metrics to the pushgateway", zap.String("url", pg.cfg.URL), zap.Error(err))
+				}
+			case <-pg.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stop the background pushes and push the final state of the metrics.
+func (pg *pushgateway) stop(ctx context.Context) {
+	close(pg.stopCh)
+	pg.wg.Wait()
+
+	err := pg.push(ctx)
+	if err != nil {
+		pg.log.Error("failed to push final metrics to the pushgateway", zap.String("url", pg.cfg.URL), zap.Error(err))
+	}
+}
+
+func (pg *pushgateway) push(ctx context.Context) error {
+	if pg.cfg.Mode == PushModeAdd {
+		return pg.pusher.AddContext(ctx)
+	}
+
+	return pg.pusher.PushContext(ctx)
+}
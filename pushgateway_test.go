@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_Pushgateway(t *testing.T) {
+	var puts, posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics/job/cron/instance/worker", r.URL.Path)
+
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", username)
+		assert.Equal(t, "secret", password)
+
+		switch r.Method {
+		case http.MethodPut:
+			puts.Add(1)
+		case http.MethodPost:
+			posts.Add(1)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total"})
+	registry.MustRegister(counter)
+	counter.Inc()
+
+	cfg := &Pushgateway{
+		URL:      srv.URL,
+		Job:      "cron",
+		Grouping: map[string]string{"instance": "worker"},
+		Interval: time.Millisecond * 10,
+		Mode:     PushModePush,
+		Username: "user",
+		Password: "secret",
+	}
+
+	pg := newPushgateway(cfg, registry, zap.NewNop())
+	pg.start()
+	time.Sleep(time.Millisecond * 50)
+	pg.stop(context.Background())
+
+	assert.Greater(t, puts.Load(), int32(1))
+	assert.Equal(t, int32(0), posts.Load())
+
+	cfg.Mode = PushModeAdd
+	pg = newPushgateway(cfg, registry, zap.NewNop())
+	pg.stop(context.Background())
+	assert.Equal(t, int32(1), posts.Load())
+}
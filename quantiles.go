@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"math"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/roadrunner-server/errors"
+)
+
+// defaultQuantiles are computed for the histograms when the query has no quantiles.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// QuantileQuery selects the series of the histogram or summary collector.
+type QuantileQuery struct {
+	Metric
+	// Quantiles to compute, in [0,1]. Histograms default to 0.5, 0.9 and 0.99, summaries to all configured objectives.
+	Quantiles []float64 `msgpack:"alias:quantiles"`
+}
+
+// QuantileValues are the current values of the series.
+type QuantileValues struct {
+	// Count of the observations, the quantiles are empty without observations.
+	Count uint64 `json:"count"`
+	// Sum of the observations.
+	Sum float64 `json:"sum"`
+	// Quantiles sorted by the quantile.
+	Quantiles []Quantile `json:"quantiles"`
+}
+
+// Quantile is the value of a single quantile.
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// seriesOf reads the current state of the series without creating it. Nil when the series has no observations yet.
+func seriesOf(col *collector, values []string) *dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		col.col.Collect(ch)
+		close(ch)
+	}()
+
+	var found *dto.Metric
+	for pm := range ch {
+		if found != nil && found.Summary != nil {
+			// drain, a mirrored summary collects its histogram as well
+			continue
+		}
+
+		m := &dto.Metric{}
+		if err := pm.Write(m); err != nil {
+			continue
+		}
+
+		if (m.Summary != nil || m.Histogram != nil) && hasLabelValues(m, col.def.Labels, values) {
+			found = m
+		}
+	}
+
+	return found
+}
+
+// hasLabelValues reports whether the metric has the given values of the variable labels.
+func hasLabelValues(m *dto.Metric, names, values []string) bool {
+	for i, name := range names {
+		idx := slices.IndexFunc(m.GetLabel(), func(lp *dto.LabelPair) bool {
+			return lp.GetName() == name
+		})
+		if idx < 0 || m.GetLabel()[idx].GetValue() != values[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// summaryQuantiles returns the requested objectives of the summary, all of them when none is requested.
+func summaryQuantiles(s *dto.Summary, requested []float64) ([]Quantile, error) {
+	out := make([]Quantile, 0, len(s.GetQuantile()))
+	for _, q := range s.GetQuantile() {
+		if len(requested) == 0 || slices.Contains(requested, q.GetQuantile()) {
+			out = append(out, Quantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+		}
+	}
+
+	for _, q := range requested {
+		if !slices.ContainsFunc(out, func(v Quantile) bool { return v.Quantile == q }) {
+			return nil, errors.Errorf("quantile %v is not an objective of the summary", q)
+		}
+	}
+
+	return out, nil
+}
+
+// histogramQuantile approximates the quantile from the classic buckets the same way as the PromQL
+// histogram_quantile does: the observations are assumed to be spread evenly in the bucket, so the value is
+// interpolated linearly between the bucket bounds. The lower bound of the first bucket is 0 (unless the upper
+// bound is negative), a quantile which falls into the +Inf bucket is the upper bound of the highest finite bucket.
+func histogramQuantile(q float64, h *dto.Histogram) float64 {
+	buckets := h.GetBucket()
+	rank := q * float64(h.GetSampleCount())
+
+	b := slices.IndexFunc(buckets, func(b *dto.Bucket) bool {
+		return float64(b.GetCumulativeCount()) >= rank
+	})
+	if b < 0 {
+		return buckets[len(buckets)-1].GetUpperBound()
+	}
+
+	upper := buckets[b].GetUpperBound()
+	if math.IsInf(upper, 1) {
+		if b == 0 {
+			return math.NaN()
+		}
+
+		return buckets[b-1].GetUpperBound()
+	}
+
+	lower, before := 0.0, 0.0
+	if b > 0 {
+		lower, before = buckets[b-1].GetUpperBound(), float64(buckets[b-1].GetCumulativeCount())
+	} else if upper <= 0 {
+		return upper
+	}
+
+	count := float64(buckets[b].GetCumulativeCount()) - before
+	if count == 0 {
+		return upper
+	}
+
+	return lower + (upper-lower)*((rank-before)/count)
+}
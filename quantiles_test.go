@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HistogramQuantile(t *testing.T) {
+	bucket := func(upper float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: &upper, CumulativeCount: &count}
+	}
+
+	count := uint64(10)
+	h := &dto.Histogram{SampleCount: &count, Bucket: []*dto.Bucket{bucket(1, 5), bucket(2, 5), bucket(4, 8)}}
+
+	assert.InDelta(t, 0.2, histogramQuantile(0.1, h), 1e-9)
+	assert.InDelta(t, 1.0, histogramQuantile(0.5, h), 1e-9)
+	assert.InDelta(t, 8.0/3, histogramQuantile(0.6, h), 1e-9)
+	// falls into +Inf
+	assert.InDelta(t, 4.0, histogramQuantile(0.9, h), 1e-9)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// refreshTimeout bounds the wait for the refreshers, so a slow provider does not stall the scrape.
+const refreshTimeout = time.Second
+
+// MetricsRefresher is an optional interface of the StatProvider. RefreshMetrics is called right before every gather,
+// so the provider updates its collectors lazily instead of running its own ticker. It should be fast, the gather does
+// not wait for it longer than a second.
+type MetricsRefresher interface {
+	RefreshMetrics()
+}
+
+// refresher tracks the in-flight refresh of the provider.
+type refresher struct {
+	r       MetricsRefresher
+	running atomic.Bool
+}
+
+// refresh calls the refreshers concurrently and waits for them up to the refreshTimeout. The refreshers which are
+// still running are left behind, their updates are exposed on the next scrape. A refresher is not called again until
+// its previous refresh returns, so a hanging provider does not pile up the goroutines.
+func (p *Plugin) refresh() {
+	if len(p.refreshers) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, rf := range p.refreshers {
+		if !rf.running.CompareAndSwap(false, true) {
+			p.log.Debug("metrics refresher is still running, skipping")
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer rf.running.Store(false)
+			// a misbehaving provider should not crash the whole process
+			defer func() {
+				if rec := recover(); rec != nil {
+					p.log.Error("metrics refresher panicked", zap.Any("panic", rec))
+				}
+			}()
+
+			rf.r.RefreshMetrics()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(refreshTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		p.log.Warn("metrics refreshers did not finish in time, gathering the current values", zap.Duration("timeout", refreshTimeout))
+	}
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registryNameRE restricts the registry names to a single URL path segment.
+var registryNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// RegistryCollector is a collector declared in the named (e.g. per-tenant) registry. The collector name is unique across
+// all registries, see DeclareInRegistry.
+type RegistryCollector struct {
+	// Registry name, created on the first declaration.
+	Registry string `json:"registry"`
+	NamedCollector
+}
+
+// subRegistry isolates the collectors of a single tenant, so they are exposed separately on /metrics/{registry}.
+type subRegistry struct {
+	registry *prometheus.Registry
+	// registerer attaches the global labels, like the root one
+	registerer prometheus.Registerer
+}
+
+// subRegistry returns the named registry, creating it when it does not exist yet.
+func (p *Plugin) subRegistry(name string) (*subRegistry, error) {
+	if !registryNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid registry name `%s`, should match %s", name, registryNameRE)
+	}
+
+	if r, ok := p.registries.Load(name); ok {
+		return r.(*subRegistry), nil
+	}
+
+	r := &subRegistry{registry: prometheus.NewRegistry()}
+	r.registerer = r.registry
+	if len(p.cfg.Labels) != 0 {
+		r.registerer = prometheus.WrapRegistererWith(p.cfg.Labels, r.registry)
+	}
+
+	actual, _ := p.registries.LoadOrStore(name, r)
+	return actual.(*subRegistry), nil
+}
+
+// registererOf returns the registerer the collector belongs to.
+func (p *Plugin) registererOf(c *collector) prometheus.Registerer {
+	if c.registry == "" {
+		return p.registerer
+	}
+
+	if r, ok := p.registries.Load(c.registry); ok {
+		return r.(*subRegistry).registerer
+	}
+
+	return p.registerer
+}
+
+// unregister removes the collector from the registry it belongs to.
+func (p *Plugin) unregister(c *collector) bool {
+	return p.registererOf(c).Unregister(c.col)
+}
+
+// gatherRegistries gathers the named registries, used to union them on the root path.
+func (p *Plugin) gatherRegistries() prometheus.Gatherers {
+	var gs prometheus.Gatherers
+	p.registries.Range(func(_, value any) bool {
+		gs = append(gs, value.(*subRegistry).registry)
+		return true
+	})
+
+	return gs
+}
+
+// registryHandler exposes a single named registry, unknown registries are not found.
+func (p *Plugin) registryHandler(opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, ok := p.registries.Load(req.PathValue("registry"))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		// the registries come and go at runtime, the handler is cheap to build per scrape, the concurrency limit is
+		// applied around it
+		promhttp.HandlerFor(p.decorate(r.(*subRegistry).registry), opts).ServeHTTP(w, req)
+	})
+}
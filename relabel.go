@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// Relabel renames or drops the metric family at scrape time, e.g. a badly named metric of a worker which can't be changed.
+type Relabel struct {
+	// Source is the full name of the metric family, e.g. app_requests_total.
+	Source string `mapstructure:"source"`
+	// Target is the new name of the family, its samples (_bucket, _sum, ...) are renamed along.
+	Target string `mapstructure:"target"`
+	// Drop removes the family from the exposition, mutually exclusive with target.
+	Drop bool `mapstructure:"drop"`
+}
+
+func validateRelabel(rules []Relabel) error {
+	sources := make(map[string]struct{}, len(rules))
+	for i, r := range rules {
+		if !model.IsValidLegacyMetricName(r.Source) {
+			return fmt.Errorf("relabel[%d]: invalid source `%s`, should match %s", i, r.Source, model.MetricNameRE)
+		}
+
+		if _, ok := sources[r.Source]; ok {
+			return fmt.Errorf("relabel[%d]: duplicate source `%s`", i, r.Source)
+		}
+		sources[r.Source] = struct{}{}
+
+		if r.Drop == (r.Target != "") {
+			return fmt.Errorf("relabel[%d]: either target or drop should be set for `%s`", i, r.Source)
+		}
+
+		if r.Target != "" && !model.IsValidLegacyMetricName(r.Target) {
+			return fmt.Errorf("relabel[%d]: invalid target `%s`, should match %s", i, r.Target, model.MetricNameRE)
+		}
+	}
+
+	return nil
+}
+
+// relabel applies the rules to the gathered families. A family renamed into the name of another family would produce
+// an invalid exposition, so the rule is skipped and the family keeps its name. The conflict is passed to the conflict
+// callback rather than returned, a gather error would fail the whole scrape.
+func relabel(g prometheus.Gatherer, rules []Relabel, conflict func(r Relabel)) prometheus.Gatherer {
+	if len(rules) == 0 {
+		return g
+	}
+
+	byName := make(map[string]Relabel, len(rules))
+	for _, r := range rules {
+		byName[r.Source] = r
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		names := make(map[string]struct{}, len(mfs))
+		for _, mf := range mfs {
+			names[mf.GetName()] = struct{}{}
+		}
+
+		out := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			r, ok := byName[mf.GetName()]
+			switch {
+			case !ok:
+				out = append(out, mf)
+			case r.Drop:
+			default:
+				if _, taken := names[r.Target]; taken {
+					conflict(r)
+					out = append(out, mf)
+					continue
+				}
+
+				names[r.Target] = struct{}{}
+				// the gathered families may be cached by the gatherer, so they are not modified in place
+				out = append(out, &dto.MetricFamily{
+					Name:   &r.Target,
+					Help:   mf.Help,
+					Type:   mf.Type,
+					Unit:   mf.Unit,
+					Metric: mf.Metric,
+				})
+			}
+		}
+
+		// the exposition is expected to be sorted by name
+		slices.SortFunc(out, func(a, b *dto.MetricFamily) int {
+			return strings.Compare(a.GetName(), b.GetName())
+		})
+
+		return out, err
+	})
+}
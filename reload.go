@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	stderr "errors"
+	"fmt"
+	"reflect"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// ReloadRequest is the collect section and the groups applied by the Reload RPC.
+type ReloadRequest struct {
+	// Collect replaces the collect section.
+	Collect map[string]Collector `json:"collect,omitempty"`
+	// Groups replace the groups.
+	Groups map[string]Group `json:"groups,omitempty"`
+}
+
+// Reload re-reads the collect section and the groups and applies them without a restart. The other options require a restart.
+//
+//   - the removed collectors are unregistered
+//   - the added collectors are registered
+//   - the collectors with a changed definition (including the type) are replaced, their values start from scratch
+//   - the collectors declared via RPC are left untouched, a new collector with the same name is skipped
+//
+// An invalid configuration is rejected as a whole. A collector which fails to (re)register keeps its previous state,
+// the error lists all such collectors.
+//
+// The section is read from the Configurer, which holds the configuration parsed on startup (and the values overwritten
+// since) rather than the source file. Use ReloadCollectors to apply the changed section of the source directly.
+func (p *Plugin) Reload() error {
+	const op = errors.Op("metrics_plugin_reload")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := &Config{}
+	err := p.cfgr.UnmarshalKey(PluginName, cfg)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	return p.reload(op, cfg)
+}
+
+// ReloadCollectors applies the given collect section and groups like Reload, e.g. the ones the worker has re-read from
+// the changed configuration file. The other options of the running configuration are kept.
+func (p *Plugin) ReloadCollectors(collect map[string]Collector, groups map[string]Group) error {
+	const op = errors.Op("metrics_plugin_reload_collectors")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := *p.cfg
+	cfg.Collect = collect
+	cfg.Groups = groups
+
+	return p.reload(op, &cfg)
+}
+
+// reload applies the collect section and the groups of the configuration. Should be called under p.mu.
+func (p *Plugin) reload(op errors.Op, cfg *Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	cl, err := cfg.getCollectors()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	// the collectors are registered by Serve, until then they are only stored
+	serving := len(p.servers) > 0
+
+	var errs []error
+	p.collectors.Range(func(key, value any) bool {
+		name := key.(string)
+		old := value.(*collector)
+		if !old.fromConfig {
+			return true
+		}
+
+		if _, ok := cl[name]; ok {
+			return true
+		}
+
+		if old.registered && !p.unregister(old) {
+			errs = append(errs, fmt.Errorf("%s: failed to unregister the removed collector", name))
+			return true
+		}
+
+		old.release()
+		p.collectors.Delete(name)
+		p.log.Debug("collector was removed on reload", zap.String("name", name))
+		return true
+	})
+
+	for name, col := range cl {
+		err := p.reloadCollector(name, col, serving)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	p.cfg.Collect = cfg.Collect
+	p.cfg.Groups = cfg.Groups
+	p.updateCollectorsCount()
+
+	if len(errs) > 0 {
+		return errors.E(op, stderr.Join(errs...))
+	}
+
+	p.log.Info("metrics configuration was reloaded", zap.Int("collectors", len(cl)))
+	return nil
+}
+
+// reloadCollector adds or replaces the collector of the collect section. Should be called under p.mu.
+func (p *Plugin) reloadCollector(name string, col *collector, serving bool) error {
+	var old *collector
+	if v, ok := p.collectors.Load(name); ok {
+		old = v.(*collector)
+		if !old.fromConfig {
+			return fmt.Errorf("the name is taken by the collector declared via RPC, skipped")
+		}
+
+		if reflect.DeepEqual(old.def, col.def) {
+			return nil
+		}
+
+		if old.registered && !p.unregister(old) {
+			return fmt.Errorf("failed to unregister the changed collector")
+		}
+	}
+
+	if serving {
+		err := p.safeRegister(col.col)
+		if err != nil {
+			// roll back, so the collector is not lost
+			if old != nil && old.registered {
+				if rerr := p.safeRegister(old.col); rerr != nil {
+					p.collectors.Delete(name)
+					old.release()
+					return stderr.Join(err, rerr)
+				}
+			}
+
+			return err
+		}
+
+		col.registered = true
+		if col.ttl != nil {
+			col.ttl.start()
+		}
+	}
+
+	if old != nil {
+		old.release()
+	}
+
+	p.watchCardinality(name, col)
+	p.collectors.Store(name, col)
+	p.log.Debug("collector was applied on reload", zap.String("name", name), zap.Bool("replaced", old != nil))
+	return nil
+}
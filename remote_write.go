@@ -0,0 +1,283 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteVersion = "0.1.0"
+	// tenantHeader is the header used by Cortex/Mimir/Thanos to identify the tenant
+	tenantHeader = "X-Scope-OrgID"
+	// initial delay between the remote-write retries, doubled on every attempt
+	remoteWriteBackoff    = time.Millisecond * 500
+	remoteWriteMaxBackoff = time.Second * 30
+)
+
+// remoteWrite periodically gathers the metrics and ships them to the remote-write endpoint.
+type remoteWrite struct {
+	cfg      *RemoteWrite
+	log      *zap.Logger
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newRemoteWrite(cfg *RemoteWrite, g prometheus.Gatherer, log *zap.Logger) *remoteWrite {
+	return &remoteWrite{
+		cfg:      cfg,
+		log:      log,
+		gatherer: g,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// start shipping metrics in the background.
+func (rw *remoteWrite) start() {
+	rw.wg.Add(1)
+	go func() {
+		defer rw.wg.Done()
+
+		ticker := time.NewTicker(rw.cfg.Interval)
+		defer ticker.Stop()
+
+		// the in-flight write is canceled on stop, the final one is sent by stop within its own context
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-rw.stopCh
+			cancel()
+		}()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := rw.write(ctx)
+				if err != nil {
+					rw.log.Warn("failed to send metrics to the remote-write endpoint", zap.String("endpoint", rw.cfg.Endpoint), zap.Error(err))
+				}
+			case <-rw.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stop the background writes and send the final state of the metrics.
+func (rw *remoteWrite) stop(ctx context.Context) {
+	close(rw.stopCh)
+	rw.wg.Wait()
+
+	err := rw.write(ctx)
+	if err != nil {
+		rw.log.Error("failed to send final metrics to the remote-write endpoint", zap.String("endpoint", rw.cfg.Endpoint), zap.Error(err))
+	}
+}
+
+// write gathers the metrics and sends them, retrying with a backoff until ctx is done or retries are exhausted.
+func (rw *remoteWrite) write(ctx context.Context) error {
+	mfs, err := rw.gatherer.Gather()
+	if err != nil {
+		// gather errors are not fatal, the families that were gathered are still sent
+		rw.log.Warn("failed to gather some metrics for the remote-write", zap.Error(err))
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(mfs, time.Now().UnixMilli()))
+
+	backoff := remoteWriteBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := rw.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt > rw.cfg.MaxRetries {
+			return err
+		}
+
+		rw.log.Debug("remote-write failed, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff = min(backoff*2, remoteWriteMaxBackoff)
+	}
+}
+
+// send a single request, returns whether the failure is worth retrying.
+func (rw *remoteWrite) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	for name, value := range rw.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if rw.cfg.TenantID != "" {
+		req.Header.Set(tenantHeader, rw.cfg.TenantID)
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote-write endpoint returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+
+	// server errors and throttling are transient, the rest of the client errors are not
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// remote-write protocol (prometheus.WriteRequest) field numbers
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+// encodeWriteRequest converts the metric families into a protobuf encoded remote-write WriteRequest.
+func encodeWriteRequest(mfs []*dto.MetricFamily, now int64) []byte {
+	var buf []byte
+	for _, mf := range mfs {
+		expandSamples(mf, func(m *dto.Metric, name string, labels []label, value float64) {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+
+			buf = appendSeries(buf, name, labels, value, ts)
+		})
+	}
+
+	return buf
+}
+
+// expandSamples calls fn for every sample of the family in the exposition form,
+// histograms and summaries are expanded into the bucket (quantile), _sum and _count samples.
+func expandSamples(mf *dto.MetricFamily, fn func(m *dto.Metric, name string, labels []label, value float64)) {
+	for _, m := range mf.GetMetric() {
+		labels := make([]label, 0, len(m.GetLabel())+1)
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, label{name: lp.GetName(), value: lp.GetValue()})
+		}
+
+		name := mf.GetName()
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			fn(m, name, labels, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			fn(m, name, labels, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			fn(m, name, labels, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				ql := append(labels[:len(labels):len(labels)], label{name: "quantile", value: formatFloat(q.GetQuantile())})
+				fn(m, name, ql, q.GetValue())
+			}
+
+			fn(m, name+"_sum", labels, s.GetSampleSum())
+			fn(m, name+"_count", labels, float64(s.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.GetBucket() {
+				// +Inf bucket is added below from the sample count
+				if math.IsInf(b.GetUpperBound(), 1) {
+					continue
+				}
+
+				bl := append(labels[:len(labels):len(labels)], label{name: "le", value: formatFloat(b.GetUpperBound())})
+				fn(m, name+"_bucket", bl, float64(b.GetCumulativeCount()))
+			}
+
+			inf := append(labels[:len(labels):len(labels)], label{name: "le", value: "+Inf"})
+			fn(m, name+"_bucket", inf, float64(h.GetSampleCount()))
+			fn(m, name+"_sum", labels, h.GetSampleSum())
+			fn(m, name+"_count", labels, float64(h.GetSampleCount()))
+		}
+	}
+}
+
+// appendSeries appends a single TimeSeries with one sample to the WriteRequest.
+func appendSeries(buf []byte, name string, labels []label, value float64, ts int64) []byte {
+	all := make([]label, 0, len(labels)+1)
+	all = append(all, label{name: "__name__", value: name})
+	all = append(all, labels...)
+	// the protocol requires labels sorted by name
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].name < all[j].name
+	})
+
+	var series []byte
+	for _, l := range all {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+
+		series = protowire.AppendTag(series, timeSeriesLabels, protowire.BytesType)
+		series = protowire.AppendBytes(series, lb)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts)) //nolint:gosec
+
+	series = protowire.AppendTag(series, timeSeriesSamples, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	buf = protowire.AppendTag(buf, writeRequestTimeseries, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
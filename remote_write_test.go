@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func Test_RemoteWrite(t *testing.T) {
+	var calls atomic.Int32
+	bodies := make(chan []byte, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "tenant", r.Header.Get(tenantHeader))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		// the first request fails to exercise the retry
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Buckets: []float64{0.1, 1}})
+	registry.MustRegister(histogram)
+	histogram.Observe(0.5)
+
+	cfg := &RemoteWrite{
+		Endpoint:   srv.URL,
+		Interval:   time.Hour,
+		Timeout:    time.Second,
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+		TenantID:   "tenant",
+		MaxRetries: 1,
+	}
+
+	rw := newRemoteWrite(cfg, registry, zap.NewNop())
+	rw.stop(context.Background())
+	assert.Equal(t, int32(2), calls.Load())
+
+	body, err := snappy.Decode(nil, <-bodies)
+	require.NoError(t, err)
+
+	// 2 buckets + the +Inf bucket, sum and count
+	assert.Equal(t, []string{
+		"latency_seconds_bucket",
+		"latency_seconds_bucket",
+		"latency_seconds_bucket",
+		"latency_seconds_sum",
+		"latency_seconds_count",
+	}, decodeSeriesNames(t, body))
+}
+
+func Test_RemoteWrite_StopDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	rw := newRemoteWrite(&RemoteWrite{Endpoint: srv.URL, Interval: time.Hour, Timeout: time.Minute, MaxRetries: 3}, prometheus.NewRegistry(), zap.NewNop())
+
+	// the final write should be abandoned once the stop deadline is exceeded
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	rw.stop(ctx)
+	assert.Less(t, time.Since(start), time.Second*5)
+}
+
+// decodeSeriesNames returns the __name__ label of every TimeSeries in the WriteRequest.
+func decodeSeriesNames(t *testing.T, b []byte) []string {
+	t.Helper()
+
+	var names []string
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		require.Positive(t, n)
+		series, m := protowire.ConsumeBytes(b[n:])
+		require.Positive(t, m)
+		b = b[n+m:]
+
+		for len(series) > 0 {
+			num, _, n := protowire.ConsumeTag(series)
+			value, m := protowire.ConsumeBytes(series[n:])
+			series = series[n+m:]
+			if num != timeSeriesLabels {
+				continue
+			}
+
+			_, _, n = protowire.ConsumeTag(value)
+			name, m := protowire.ConsumeString(value[n:])
+			_, _, k := protowire.ConsumeTag(value[n+m:])
+			val, _ := protowire.ConsumeString(value[n+m+k:])
+			if name == "__name__" {
+				names = append(names, val)
+			}
+		}
+	}
+
+	return names
+}
@@ -1,11 +1,30 @@
 package metrics
 
 import (
+	"bytes"
+	"cmp"
+	stderr "errors"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	"github.com/roadrunner-server/errors"
 	"go.uber.org/zap"
 )
 
+const (
+	// maxGatherSize limits the payload of the Gather RPC
+	maxGatherSize = 32 << 20 // 32MB
+	// maxBulkObservations limits the observations replayed by a single ObserveBulk
+	maxBulkObservations = 1 << 20
+)
+
 type rpc struct {
 	p   *Plugin
 	log *zap.Logger
@@ -19,73 +38,240 @@ type Metric struct {
 	Value float64 `msgpack:"alias:value"`
 	// Labels associated with metric. Only for vector metrics. Must be provided in a form of label values.
 	Labels []string `msgpack:"alias:labels"`
+	// Exemplar labels attached to the observation, e.g. a trace id. Only for histograms and counters.
+	Exemplar map[string]string `msgpack:"alias:exemplar"`
+	// LabelMap associated with metric, keyed by the label names. Takes precedence over Labels.
+	LabelMap map[string]string `msgpack:"alias:label_map"`
+	// Start is a unix timestamp in nanoseconds, ObserveDuration computes the duration from it using the plugin clock.
+	Start int64 `msgpack:"alias:start"`
+	// DurationNanos is the duration measured by the worker with its monotonic clock, observed by ObserveDuration as is,
+	// so the RPC transport delay is not included. Takes precedence over Start and Value.
+	DurationNanos int64 `msgpack:"alias:duration_nanos"`
+}
+
+// BulkObservation is a batch of the observations aggregated by the worker. Value of the metric is ignored.
+type BulkObservation struct {
+	Metric
+	// Observations replayed into the collector.
+	Observations []Observation `msgpack:"alias:observations"`
+}
+
+// Observation is the value observed Count times.
+type Observation struct {
+	Value float64 `msgpack:"alias:value"`
+	Count uint64  `msgpack:"alias:count"`
+}
+
+// EnumMetric is the state of the enum gauge, see SetEnum.
+type EnumMetric struct {
+	Metric
+	// State is the active value of the enum label.
+	State string `msgpack:"alias:state"`
+}
+
+// CollectorState enables or disables the exposition of the collector, see SetEnabled.
+type CollectorState struct {
+	// Name of the collector.
+	Name string `msgpack:"alias:name"`
+	// Enabled exposes the collector, a disabled collector is skipped by the scrapes.
+	Enabled bool `msgpack:"alias:enabled"`
+}
+
+// DeclareReply is the reply of DeclareWithReply.
+type DeclareReply struct {
+	// Name of the collector used in the RPC calls.
+	Name string `json:"name"`
+	// FQName is the name exposed to the scrapers, e.g. app_http_requests_total.
+	FQName string `json:"fq_name"`
+}
+
+// CollectorInfo describes a collector known to the plugin.
+type CollectorInfo struct {
+	// Name of the collector
+	Name string `json:"name"`
+	// Type of the collector
+	Type CollectorType `json:"type"`
+	// Namespace of the metric
+	Namespace string `json:"namespace,omitempty"`
+	// Subsystem of the metric
+	Subsystem string `json:"subsystem,omitempty"`
+	// Labels of the vectorized metric
+	Labels []string `json:"labels,omitempty"`
+	// Registered reports whether the collector is registered in the prometheus registry
+	Registered bool `json:"registered"`
+	// Owner is the worker which declared the collector
+	Owner string `json:"owner,omitempty"`
+	// Disabled reports whether the collector is skipped by the scrapes, see SetEnabled
+	Disabled bool `json:"disabled,omitempty"`
 }
 
 // Add new metric to the designated collector.
-func (r *rpc) Add(m *Metric, ok *bool) error {
+func (r *rpc) Add(m *Metric, ok *bool) (err error) {
 	const op = errors.Op("metrics_plugin_add")
-	r.log.Debug("adding metric", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
-	c, exist := r.p.collectors.Load(m.Name)
+	defer r.p.selfMetrics.observeRPC("add", time.Now(), &err)
+
+	r.log.Debug("adding metric", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Counter)
 	if !exist {
 		r.log.Error("undefined collector", zap.String("collector", m.Name))
-		return errors.E(op, errors.Errorf("undefined collector %s, try first Declare the desired collector", m.Name))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s, try first Declare the desired collector", m.Name)))
 	}
 
 	col := c.(*collector)
 
 	switch c := col.col.(type) {
 	case prometheus.Gauge:
-		c.Add(m.Value)
+		err := addWithExemplar(c, m)
+		if err != nil {
+			return errors.E(op, err)
+		}
 
 	case *prometheus.GaugeVec:
-		if len(m.Labels) == 0 {
-			r.log.Error("required labels for collector", zap.String("collector", m.Name))
-			return errors.E(op, errors.Errorf("required labels for collector %s", m.Name))
+		gauge, err := child[prometheus.Gauge](c, col, m)
+		if err != nil {
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
+			return errors.E(op, err)
 		}
 
-		gauge, err := c.GetMetricWithLabelValues(m.Labels...)
+		err = addWithExemplar(gauge, m)
 		if err != nil {
-			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), zap.Strings("labels", m.Labels))
 			return errors.E(op, err)
 		}
-		gauge.Add(m.Value)
 	case prometheus.Counter:
-		c.Add(m.Value)
+		err := addWithExemplar(c, m)
+		if err != nil {
+			return errors.E(op, err)
+		}
 
 	case *prometheus.CounterVec:
-		if len(m.Labels) == 0 {
-			return errors.E(op, errors.Errorf("required labels for collector `%s`", m.Name))
+		gauge, err := child[prometheus.Counter](c, col, m)
+		if err != nil {
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
+			return errors.E(op, err)
 		}
 
-		gauge, err := c.GetMetricWithLabelValues(m.Labels...)
+		err = addWithExemplar(gauge, m)
 		if err != nil {
-			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), zap.Strings("labels", m.Labels))
 			return errors.E(op, err)
 		}
-		gauge.Add(m.Value)
 
 	default:
-		return errors.E(op, errors.Errorf("collector %s does not support method `Add`", m.Name))
+		return errors.E(op, unsupported(col, m.Name, "Add"))
 	}
 
+	col.touch(m)
+	r.p.mirror(col, m, statsdAdd, m.Value)
+
 	// RPC, set ok to true as return value. Need by r.Call reply argument
 	*ok = true
-	r.log.Debug("metric successfully added", zap.String("name", m.Name), zap.Strings("labels", m.Labels), zap.Float64("value", m.Value))
+	r.log.Debug("metric successfully added", zap.String("name", m.Name), r.labels(m), zap.Float64("value", m.Value))
+	return nil
+}
+
+// Inc increments the counter or gauge without labels by one.
+func (r *rpc) Inc(name string, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_inc")
+	defer r.p.selfMetrics.observeRPC("inc", time.Now(), &err)
+
+	err = r.inc(op, &Metric{Name: name})
+	if err != nil {
+		return err
+	}
+
+	*ok = true
+	return nil
+}
+
+// IncLabels increments the counter or gauge vector child by one, the value of the metric is ignored.
+func (r *rpc) IncLabels(m *Metric, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_inc_labels")
+	defer r.p.selfMetrics.observeRPC("inc_labels", time.Now(), &err)
+
+	err = r.inc(op, m)
+	if err != nil {
+		return err
+	}
+
+	*ok = true
+	return nil
+}
+
+// inc increments the counter or gauge by one.
+func (r *rpc) inc(op errors.Op, m *Metric) error {
+	r.log.Debug("incrementing metric", zap.String("name", m.Name), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Counter)
+	if !exist {
+		r.log.Error("undefined collector", zap.String("collector", m.Name))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s, try first Declare the desired collector", m.Name)))
+	}
+
+	col := c.(*collector)
+
+	// gauge satisfies the counter interface, so it goes first
+	switch c := col.col.(type) {
+	case prometheus.Gauge:
+		c.Inc()
+
+	case prometheus.Counter:
+		c.Inc()
+
+	case *prometheus.GaugeVec:
+		gauge, err := child[prometheus.Gauge](c, col, m)
+		if err != nil {
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
+			return errors.E(op, err)
+		}
+		gauge.Inc()
+
+	case *prometheus.CounterVec:
+		counter, err := child[prometheus.Counter](c, col, m)
+		if err != nil {
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
+			return errors.E(op, err)
+		}
+		counter.Inc()
+
+	default:
+		return errors.E(op, unsupported(col, m.Name, "Inc"))
+	}
+
+	col.touch(m)
+	r.p.mirror(col, m, statsdAdd, 1)
+
+	r.log.Debug("increment operation finished successfully", zap.String("name", m.Name), r.labels(m))
 	return nil
 }
 
-// Sub subtract the value from the specific metric (gauge only).
-func (r *rpc) Sub(m *Metric, ok *bool) error {
+// Sub subtract the value from the specific metric (gauge only). With require_label_map the labels of the vector gauge
+// should be keyed by the names.
+func (r *rpc) Sub(m *Metric, ok *bool) (err error) {
 	const op = errors.Op("metrics_plugin_sub")
-	r.log.Debug("subtracting value from metric", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
-	c, exist := r.p.collectors.Load(m.Name)
+	defer r.p.selfMetrics.observeRPC("sub", time.Now(), &err)
+
+	r.log.Debug("subtracting value from metric", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Gauge)
 	if !exist {
-		r.log.Error("undefined collector", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
+		r.log.Error("undefined collector", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
 	}
 	if c == nil {
 		// can it be a nil ??? I guess can't
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
 	}
 
 	col := c.(*collector)
@@ -95,234 +281,1132 @@ func (r *rpc) Sub(m *Metric, ok *bool) error {
 		c.Sub(m.Value)
 
 	case *prometheus.GaugeVec:
-		if len(m.Labels) == 0 {
-			r.log.Error("required labels for collector, but none was provided", zap.String("name", m.Name), zap.Float64("value", m.Value))
-			return errors.E(op, errors.Errorf("required labels for collector %s", m.Name))
+		if err := r.p.checkLabelMap(m); err != nil {
+			return errors.E(op, err)
 		}
 
-		gauge, err := c.GetMetricWithLabelValues(m.Labels...)
+		gauge, err := child[prometheus.Gauge](c, col, m)
 		if err != nil {
-			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), zap.Strings("labels", m.Labels))
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
 			return errors.E(op, err)
 		}
 		gauge.Sub(m.Value)
 	default:
-		return errors.E(op, errors.Errorf("collector `%s` does not support method `Sub`", m.Name))
+		return errors.E(op, unsupported(col, m.Name, "Sub"))
 	}
-	r.log.Debug("subtracting operation finished successfully", zap.String("name", m.Name), zap.Strings("labels", m.Labels), zap.Float64("value", m.Value))
+
+	col.touch(m)
+	r.p.mirror(col, m, statsdSub, m.Value)
+
+	r.log.Debug("subtracting operation finished successfully", zap.String("name", m.Name), r.labels(m), zap.Float64("value", m.Value))
 
 	*ok = true
 	return nil
 }
 
 // Observe the value (histogram and summary only).
-func (r *rpc) Observe(m *Metric, ok *bool) error {
+func (r *rpc) Observe(m *Metric, ok *bool) (err error) {
 	const op = errors.Op("metrics_plugin_observe")
-	r.log.Debug("observing metric", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
+	defer r.p.selfMetrics.observeRPC("observe", time.Now(), &err)
 
-	c, exist := r.p.collectors.Load(m.Name)
+	err = r.observe(op, m, statsdObserve)
+	if err != nil {
+		return err
+	}
+
+	*ok = true
+	return nil
+}
+
+// ObserveDuration observes a duration in seconds (histogram and summary only).
+// The value is interpreted as nanoseconds. When Start is set, the duration is computed from it against the plugin clock
+// instead, which includes the time the call spent in the transport. DurationNanos measured by the worker is preferred
+// for the latency SLOs, as it does not depend on the transport timing.
+func (r *rpc) ObserveDuration(m *Metric, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_observe_duration")
+	defer r.p.selfMetrics.observeRPC("observe_duration", time.Now(), &err)
+
+	dm := *m
+	switch {
+	case m.DurationNanos != 0:
+		dm.Value = time.Duration(m.DurationNanos).Seconds()
+	case m.Start != 0:
+		dm.Value = time.Since(time.Unix(0, m.Start)).Seconds()
+	default:
+		dm.Value = m.Value / float64(time.Second)
+	}
+
+	if dm.Value < 0 {
+		return errors.E(op, withCode(CodeInvalidValue, errors.Errorf("negative duration for collector %s", m.Name)))
+	}
+
+	err = r.observe(op, &dm, statsdObserveDuration)
+	if err != nil {
+		return err
+	}
+
+	*ok = true
+	return nil
+}
+
+// observe the value in the histogram or summary collector, mirrored to StatsD as the given kind of the observation.
+func (r *rpc) observe(op errors.Op, m *Metric, kind statsdOp) error {
+	r.log.Debug("observing metric", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Histogram)
 	if !exist {
-		r.log.Error("undefined collector", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
+		r.log.Error("undefined collector", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
 	}
 	if c == nil {
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
 	}
 
 	col := c.(*collector)
 
-	switch c := col.col.(type) {
-	case *prometheus.SummaryVec:
-		if len(m.Labels) == 0 {
-			return errors.E(op, errors.Errorf("required labels for collector `%s`", m.Name))
+	observer, err := observerOf(col, m, "Observe")
+	if err != nil {
+		r.log.Error("failed to get the observer", zap.String("collector", m.Name), r.labels(m))
+		return errors.E(op, err)
+	}
+
+	err = observeWithExemplar(observer, m)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	col.touch(m)
+	r.p.mirror(col, m, kind, m.Value)
+
+	r.log.Debug("observe operation finished successfully", zap.String("name", m.Name), r.labels(m), zap.Float64("value", m.Value))
+
+	return nil
+}
+
+// ObserveBulk replays the observations aggregated by the worker (histogram and summary only), e.g. the counts per
+// latency bucket gathered during a batch. Every observation is recorded at its value, so the counts aggregated per
+// bucket should be sent with a value inside the bucket: the upper bound keeps the bucket counts exact, but overestimates
+// the sum and the summary quantiles. Exemplars are not supported.
+func (r *rpc) ObserveBulk(b *BulkObservation, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_observe_bulk")
+	defer r.p.selfMetrics.observeRPC("observe_bulk", time.Now(), &err)
+
+	m := &b.Metric
+	if len(m.Exemplar) > 0 {
+		return errors.E(op, withCode(CodeInvalidExemplar, errors.Errorf("exemplars are not supported by the bulk observations of collector %s", m.Name)))
+	}
+
+	var total uint64
+	for _, o := range b.Observations {
+		if math.IsNaN(o.Value) {
+			return errors.E(op, withCode(CodeInvalidValue, errors.Errorf("NaN observation for collector %s", m.Name)))
 		}
 
-		observer, err := c.GetMetricWithLabelValues(m.Labels...)
-		if err != nil {
-			return errors.E(op, err)
+		// compared before the addition, the sum of the counts could overflow
+		if o.Count > maxBulkObservations-total {
+			return errors.E(op, withCode(CodeInvalidValue, errors.Errorf("too many bulk observations for collector %s, the limit is %d", m.Name, maxBulkObservations)))
 		}
-		observer.Observe(m.Value)
+		total += o.Count
+	}
 
-	case prometheus.Histogram:
-		c.Observe(m.Value)
+	if err = r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
 
-	case *prometheus.HistogramVec:
-		if len(m.Labels) == 0 {
-			return errors.E(op, errors.Errorf("required labels for collector `%s`", m.Name))
-		}
+	c, exist := r.load(m, Histogram)
+	if !exist || c == nil {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
+	}
 
-		observer, err := c.GetMetricWithLabelValues(m.Labels...)
-		if err != nil {
-			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), zap.Strings("labels", m.Labels))
-			return errors.E(op, err)
+	col := c.(*collector)
+	observer, err := observerOf(col, m, "ObserveBulk")
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	for _, o := range b.Observations {
+		for range o.Count {
+			observer.Observe(o.Value)
 		}
-		observer.Observe(m.Value)
-	default:
-		return errors.E(op, errors.Errorf("collector `%s` does not support method `Observe`", m.Name))
 	}
 
-	r.log.Debug("observe operation finished successfully", zap.String("name", m.Name), zap.Strings("labels", m.Labels), zap.Float64("value", m.Value))
+	col.touch(m)
+	r.p.mirrorBulk(col, m, b.Observations)
 
 	*ok = true
 	return nil
 }
 
-// Declare is used to register new collector in prometheus
-func (r *rpc) Declare(nc *NamedCollector, ok *bool) error {
-	const op = errors.Op("metrics_plugin_declare")
-	r.p.mu.Lock()
-	defer r.p.mu.Unlock()
+// Quantiles reads back the current quantiles of the histogram or summary series, e.g. for the SLO burn rate, without
+// creating the series. Summaries return the values of the configured objectives, histograms approximate the quantiles
+// from the bucket counts (see histogramQuantile), so the accuracy depends on the buckets.
+func (r *rpc) Quantiles(q *QuantileQuery, out *QuantileValues) (err error) {
+	const op = errors.Op("metrics_plugin_quantiles")
+	defer r.p.selfMetrics.observeRPC("quantiles", time.Now(), &err)
 
-	r.log.Debug("declaring new metric", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
-	_, exist := r.p.collectors.Load(nc.Name)
-	if exist {
-		r.log.Warn("metric with provided name already exist", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
-		*ok = true
-		return nil
+	m := &q.Metric
+	c, exist := r.p.collectors.Load(m.Name)
+	if !exist {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
 	}
 
-	var promCol prometheus.Collector
-	switch nc.Type {
-	case Histogram:
-		opts := prometheus.HistogramOpts{
-			Name:      nc.Name,
-			Namespace: nc.Namespace,
-			Subsystem: nc.Subsystem,
-			Help:      nc.Help,
-			Buckets:   nc.Buckets,
+	col := c.(*collector)
+	if col.def.Type != Histogram && col.def.Type != Summary {
+		return errors.E(op, unsupported(col, m.Name, "Quantiles"))
+	}
+
+	for _, v := range q.Quantiles {
+		if !(v >= 0 && v <= 1) {
+			return errors.E(op, withCode(CodeInvalidValue, errors.Errorf("quantile %v should be in [0,1]", v)))
 		}
+	}
 
-		if len(nc.Labels) != 0 {
-			promCol = prometheus.NewHistogramVec(opts, nc.Labels)
-		} else {
-			promCol = prometheus.NewHistogram(opts)
+	values := col.labelValues(m)
+	if len(values) != len(col.def.Labels) || (len(m.LabelMap) != 0 && len(m.LabelMap) != len(col.def.Labels)) {
+		return errors.E(op, withCode(CodeInvalidLabels, errors.Errorf("collector %s requires the values of the labels %v", m.Name, col.def.Labels)))
+	}
+
+	for name := range m.LabelMap {
+		if !slices.Contains(col.def.Labels, name) {
+			return errors.E(op, withCode(CodeInvalidLabels, errors.Errorf("unknown label %s of collector %s", name, m.Name)))
 		}
-	case Gauge:
-		opts := prometheus.GaugeOpts{
-			Name:      nc.Name,
-			Namespace: nc.Namespace,
-			Subsystem: nc.Subsystem,
-			Help:      nc.Help,
+	}
+
+	res := QuantileValues{Quantiles: []Quantile{}}
+	series := seriesOf(col, values)
+
+	switch {
+	case series == nil:
+	case series.Summary != nil:
+		res.Count, res.Sum = series.Summary.GetSampleCount(), series.Summary.GetSampleSum()
+		if res.Count == 0 {
+			break
 		}
 
-		if len(nc.Labels) != 0 {
-			promCol = prometheus.NewGaugeVec(opts, nc.Labels)
-		} else {
-			promCol = prometheus.NewGauge(opts)
+		res.Quantiles, err = summaryQuantiles(series.Summary, q.Quantiles)
+		if err != nil {
+			return errors.E(op, withCode(CodeInvalidValue, err))
 		}
-	case Counter:
-		opts := prometheus.CounterOpts{
-			Name:      nc.Name,
-			Namespace: nc.Namespace,
-			Subsystem: nc.Subsystem,
-			Help:      nc.Help,
+	default:
+		h := series.Histogram
+		res.Count, res.Sum = h.GetSampleCount(), h.GetSampleSum()
+		if res.Count == 0 {
+			break
 		}
 
-		if len(nc.Labels) != 0 {
-			promCol = prometheus.NewCounterVec(opts, nc.Labels)
-		} else {
-			promCol = prometheus.NewCounter(opts)
+		if len(h.GetBucket()) == 0 {
+			return errors.E(op, withCode(CodeUnsupportedMethod, errors.Errorf("quantiles of the native histogram %s are not supported", m.Name)))
 		}
-	case Summary:
-		opts := prometheus.SummaryOpts{
-			Name:       nc.Name,
-			Namespace:  nc.Namespace,
-			Subsystem:  nc.Subsystem,
-			Help:       nc.Help,
-			Objectives: nc.Objectives,
+
+		quantiles := q.Quantiles
+		if len(quantiles) == 0 {
+			quantiles = defaultQuantiles
 		}
 
-		if len(nc.Labels) != 0 {
-			promCol = prometheus.NewSummaryVec(opts, nc.Labels)
-		} else {
-			promCol = prometheus.NewSummary(opts)
+		for _, v := range quantiles {
+			res.Quantiles = append(res.Quantiles, Quantile{Quantile: v, Value: histogramQuantile(v, h)})
 		}
+	}
+
+	slices.SortFunc(res.Quantiles, func(a, b Quantile) int {
+		return cmp.Compare(a.Quantile, b.Quantile)
+	})
 
+	*out = res
+	return nil
+}
+
+// observerOf returns the observer of the histogram or summary collector for the label values of the metric.
+func observerOf(col *collector, m *Metric, method string) (prometheus.Observer, error) {
+	switch c := col.col.(type) {
+	case *prometheus.SummaryVec:
+		return child[prometheus.Observer](c, col, m)
+	case *mirroredSummaryVec:
+		return child[prometheus.Observer](c, col, m)
+	case prometheus.Histogram:
+		return c, nil
+	case *prometheus.HistogramVec:
+		return child[prometheus.Observer](c, col, m)
 	default:
-		return errors.E(op, errors.Errorf("unknown collector type %s", nc.Type))
+		return nil, unsupported(col, m.Name, method)
+	}
+}
+
+// load returns the collector of the metric. With auto_declare, an unknown collector is declared on the first use
+// with the given type, the label names are taken from the label map.
+func (r *rpc) load(m *Metric, typ CollectorType) (any, bool) {
+	c, exist := r.p.collectors.Load(m.Name)
+	if exist || !r.p.cfg.AutoDeclare {
+		return c, exist
 	}
 
-	// that method might panic, we handle it by recover
-	err := r.p.Register(promCol)
-	if err != nil {
-		*ok = false
-		return errors.E(op, err)
+	// the names of the positional labels are unknown
+	if len(m.Labels) != 0 && len(m.LabelMap) == 0 {
+		r.log.Debug("collector with positional labels can't be auto-declared, use the label map", zap.String("name", m.Name))
+		return nil, false
 	}
 
-	col := &collector{
-		col:        promCol,
-		registered: true,
+	labels := make([]string, 0, len(m.LabelMap))
+	for name := range m.LabelMap {
+		labels = append(labels, name)
 	}
+	slices.Sort(labels)
 
-	// add collector to sync.Map
-	r.p.collectors.Store(nc.Name, col)
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
 
-	r.log.Debug("metric successfully added", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
+	err := r.declare("", &NamedCollector{Name: m.Name, Collector: Collector{
+		Type:   typ,
+		Help:   "Automatically declared on the first use of " + m.Name + ".",
+		Labels: labels,
+	}})
+	if err != nil {
+		r.log.Warn("failed to auto-declare collector", zap.String("name", m.Name), zap.Error(err))
+		return nil, false
+	}
+
+	r.p.updateCollectorsCount()
+	r.log.Warn("collector was auto-declared, declare it explicitly for production", zap.String("name", m.Name), zap.Any("type", typ), zap.Strings("labels", labels))
+
+	return r.p.collectors.Load(m.Name)
+}
+
+// Declare is used to register new collector in prometheus
+func (r *rpc) Declare(nc *NamedCollector, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_declare")
+	defer r.p.selfMetrics.observeRPC("declare", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	err = r.declare("", nc)
+	if err != nil {
+		*ok = false
+		return errors.E(op, err)
+	}
+
+	r.p.updateCollectorsCount()
 
 	*ok = true
 	return nil
 }
 
-// Unregister removes collector from the prometheus registry
-func (r *rpc) Unregister(name string, ok *bool) error {
-	const op = errors.Op("metrics_plugin_unregister")
+// DeclareWithReply declares the collector like Declare, the reply has the fully qualified name of the collector as
+// exposed to the scrapers (namespace_subsystem_name). Declare replies with a bool only, it is kept for compatibility.
+func (r *rpc) DeclareWithReply(nc *NamedCollector, out *DeclareReply) (err error) {
+	const op = errors.Op("metrics_plugin_declare_with_reply")
+	defer r.p.selfMetrics.observeRPC("declare_with_reply", time.Now(), &err)
 
-	r.log.Debug("unregistering collector", zap.String("name", name))
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
 
-	c, exist := r.p.collectors.LoadAndDelete(name)
-	if !exist || c == nil {
-		return errors.E(op, errors.Errorf("undefined collector %s", name))
+	err = r.declare("", nc)
+	if err != nil {
+		return errors.E(op, err)
 	}
 
-	if col, k := c.(*collector); k {
-		if r.p.registry.Unregister(col.col) {
-			*ok = true
-			r.log.Debug("collector was successfully unregistered", zap.String("name", name))
-			return nil
-		}
+	r.p.updateCollectorsCount()
+
+	// the collector might have been declared before with another definition, that one is exposed
+	c, ok := r.p.collectors.Load(nc.Name)
+	if !ok {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", nc.Name)))
+	}
 
-		r.log.Debug("collector was deleted from the RR registry but not from the prometheus collector", zap.String("name", name))
+	*out = DeclareReply{
+		Name:   nc.Name,
+		FQName: r.p.fqName(nc.Name, c.(*collector)),
 	}
 
 	return nil
 }
 
-// Set the metric value (only for gaude).
-func (r *rpc) Set(m *Metric, ok *bool) (err error) {
-	const op = errors.Op("metrics_plugin_set")
-	r.log.Debug("observing metric", zap.String("name", m.Name), zap.Float64("value", m.Value), zap.Strings("labels", m.Labels))
+// DeclareInRegistry declares the collector in the named registry (e.g. per tenant), created on the first declaration.
+// The registry is exposed separately on /metrics/{registry} and is a part of the root endpoint. Collector names are
+// shared by all registries, so the other RPC methods address the collector by its name only. As a consequence, two
+// registries can't declare the same name: the tenants should prefix their collector names (e.g. tenant_a_jobs_total)
+// or be told apart by a label of a collector shared by all of them.
+func (r *rpc) DeclareInRegistry(rc *RegistryCollector, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_declare_in_registry")
+	defer r.p.selfMetrics.observeRPC("declare_in_registry", time.Now(), &err)
 
-	c, exist := r.p.collectors.Load(m.Name)
-	if !exist {
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
-	}
-	if c == nil {
-		return errors.E(op, errors.Errorf("undefined collector %s", m.Name))
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	err = r.declare(rc.Registry, &rc.NamedCollector)
+	if err != nil {
+		*ok = false
+		return errors.E(op, err)
 	}
 
-	col := c.(*collector)
+	r.p.updateCollectorsCount()
 
-	switch c := col.col.(type) {
-	case prometheus.Gauge:
-		c.Set(m.Value)
+	*ok = true
+	return nil
+}
 
-	case *prometheus.GaugeVec:
-		if len(m.Labels) == 0 {
-			r.log.Error("required labels for collector", zap.String("collector", m.Name))
-			return errors.E(op, errors.Errorf("required labels for collector %s", m.Name))
+// DeclareBatch declares multiple collectors at once. The successfully declared collectors are kept even when
+// some of them fail, the returned error lists the failed ones by name.
+func (r *rpc) DeclareBatch(ncs []*NamedCollector, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_declare_batch")
+	defer r.p.selfMetrics.observeRPC("declare_batch", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	var errs []error
+	for _, nc := range ncs {
+		if nc == nil {
+			continue
 		}
-		gauge, err := c.GetMetricWithLabelValues(m.Labels...)
+
+		if err := r.declare("", nc); err != nil {
+			errs = append(errs, errors.Errorf("%s: %v", nc.Name, err))
+		}
+	}
+
+	r.p.updateCollectorsCount()
+
+	if len(errs) > 0 {
+		*ok = false
+		return errors.E(op, stderr.Join(errs...))
+	}
+
+	*ok = true
+	return nil
+}
+
+// declare creates and registers a new collector in the named registry (empty for the root one), an already existing
+// one is skipped. Should be called under p.mu.
+func (r *rpc) declare(registry string, nc *NamedCollector) (err error) {
+	// prometheus panics on invalid collectors (e.g. unsorted buckets), that should not crash the whole process
+	defer func() {
+		if rec := recover(); rec != nil {
+			r.p.selfMetrics.declareErrors.Inc()
+			r.log.Error("failed to declare collector", zap.String("name", nc.Name), zap.Any("panic", rec))
+			err = withCode(CodeInvalidCollector, errors.Errorf("failed to declare collector %s: %v", nc.Name, rec))
+		}
+	}()
+
+	r.log.Debug("declaring new metric", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
+	existing, exist := r.p.collectors.Load(nc.Name)
+	if exist && existing.(*collector).registry != registry {
+		// the collectors are addressed by the name only, so the name can't be shared by the registries
+		return withCode(CodeInvalidCollector, errors.Errorf("collector %s is already declared in another registry", nc.Name))
+	}
+
+	if exist {
+		r.log.Warn("metric with provided name already exist", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
+		return nil
+	}
+
+	promName := r.p.cfg.sanitizeNames(nc.Name, &nc.Collector)
+	if promName != nc.Name {
+		r.log.Debug("collector name was sanitized", zap.String("name", nc.Name), zap.String("sanitized", promName))
+	}
+
+	err = r.p.cfg.forceNamespace(nc.Name, &nc.Collector)
+	if err != nil {
+		return withCode(CodeInvalidCollector, err)
+	}
+
+	err = r.p.cfg.checkHelp(nc.Name, &nc.Collector)
+	if err != nil {
+		return withCode(CodeInvalidCollector, err)
+	}
+
+	err = r.p.cfg.checkUnits(nc.Name, &nc.Collector)
+	if err != nil {
+		return withCode(CodeInvalidCollector, err)
+	}
+
+	promCol, err := newCollector(promName, &nc.Collector)
+	if err != nil {
+		return withCode(CodeInvalidCollector, err)
+	}
+
+	reg := r.p.registerer
+	// the registry created for the collector is dropped when the collector fails to register, so it is not served empty
+	created := false
+	if registry != "" {
+		_, existed := r.p.registries.Load(registry)
+		sub, err := r.p.subRegistry(registry)
+		if err != nil {
+			return withCode(CodeInvalidCollector, err)
+		}
+		reg = sub.registerer
+		created = !existed
+	}
+
+	err = safeRegister(reg, promCol)
+	if err != nil {
+		if created {
+			r.p.registries.Delete(registry)
+		}
+
+		r.p.selfMetrics.declareErrors.Inc()
+		return withCode(CodeRegistry, err)
+	}
+
+	col := wrapCollector(promCol, &nc.Collector, true)
+	col.redactLabels = !r.p.cfg.logLabels()
+	col.registry = registry
+	col.owner = nc.Owner
+	r.p.watchCardinality(nc.Name, col)
+
+	if col.ttl != nil {
+		col.ttl.start()
+	}
+
+	// add collector to sync.Map
+	r.p.collectors.Store(nc.Name, col)
+
+	r.log.Debug("metric successfully added", zap.String("name", nc.Name), zap.Any("type", nc.Type), zap.String("namespace", nc.Namespace))
+	return nil
+}
+
+// Unregister removes collector from the prometheus registry
+func (r *rpc) Unregister(name string, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_unregister")
+	defer r.p.selfMetrics.observeRPC("unregister", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	r.log.Debug("unregistering collector", zap.String("name", name))
+
+	c, exist := r.p.collectors.LoadAndDelete(name)
+	if !exist || c == nil {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", name)))
+	}
+
+	col := c.(*collector)
+	// the collectors from the configuration are not registered until Serve
+	if col.registered && !r.p.unregister(col) {
+		// roll back, so the plugin and the prometheus registry do not diverge
+		r.p.collectors.Store(name, col)
+		r.log.Debug("collector was not found in the prometheus registry, keeping it", zap.String("name", name))
+		return errors.E(op, withCode(CodeRegistry, errors.Errorf("failed to unregister collector %s from the prometheus registry", name)))
+	}
+
+	col.release()
+	r.p.updateCollectorsCount()
+
+	r.log.Debug("collector was successfully unregistered", zap.String("name", name))
+
+	*ok = true
+	return nil
+}
+
+// UnregisterAll removes all collectors declared via configuration and RPC from the prometheus registry.
+// The default Go and process collectors as well as the StatProviders collectors are preserved. The collectors which
+// failed to unregister are kept and reported.
+func (r *rpc) UnregisterAll(_ struct{}, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_unregister_all")
+	defer r.p.selfMetrics.observeRPC("unregister_all", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	var failed []string
+	r.p.collectors.Range(func(key, value any) bool {
+		col := value.(*collector)
+		// the collector which failed to unregister is kept, so it can still be updated or unregistered again
+		if col.registered && !r.p.unregister(col) {
+			failed = append(failed, key.(string))
+			return true
+		}
+
+		col.release()
+		r.p.collectors.Delete(key)
+		return true
+	})
+
+	r.p.updateCollectorsCount()
+
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		return errors.E(op, withCode(CodeRegistry, errors.Errorf("failed to unregister collectors from the prometheus registry: %s", strings.Join(failed, ", "))))
+	}
+
+	r.log.Debug("all collectors were successfully unregistered")
+
+	*ok = true
+	return nil
+}
+
+// UnregisterByOwner removes all collectors declared by the owner, e.g. when the worker dies. The number of
+// the removed collectors is returned, the collectors which failed to unregister are kept and reported.
+func (r *rpc) UnregisterByOwner(owner string, count *int) (err error) {
+	const op = errors.Op("metrics_plugin_unregister_by_owner")
+	defer r.p.selfMetrics.observeRPC("unregister_by_owner", time.Now(), &err)
+
+	if owner == "" {
+		return errors.E(op, withCode(CodeInvalidCollector, errors.Str("owner should not be empty")))
+	}
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	var failed []string
+	removed := 0
+	r.p.collectors.Range(func(key, value any) bool {
+		col := value.(*collector)
+		if col.owner != owner {
+			return true
+		}
+
+		if col.registered && !r.p.unregister(col) {
+			failed = append(failed, key.(string))
+			return true
+		}
+
+		col.release()
+		r.p.collectors.Delete(key)
+		removed++
+		return true
+	})
+
+	r.p.updateCollectorsCount()
+	*count = removed
+
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		return errors.E(op, withCode(CodeRegistry, errors.Errorf("failed to unregister collectors of %s from the prometheus registry: %s", owner, strings.Join(failed, ", "))))
+	}
+
+	r.log.Debug("collectors of the owner were unregistered", zap.String("owner", owner), zap.Int("count", removed))
+	return nil
+}
+
+// DropRegistry removes the named registry with all collectors declared in it, e.g. when the tenant is gone.
+func (r *rpc) DropRegistry(name string, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_drop_registry")
+	defer r.p.selfMetrics.observeRPC("drop_registry", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	if _, exist := r.p.registries.LoadAndDelete(name); !exist {
+		return errors.E(op, withCode(CodeUndefinedRegistry, errors.Errorf("undefined registry %s", name)))
+	}
+
+	// the whole registry is gone, so the collectors do not need to be unregistered one by one
+	r.p.collectors.Range(func(key, value any) bool {
+		col := value.(*collector)
+		if col.registry == name {
+			col.release()
+			r.p.collectors.Delete(key)
+		}
+		return true
+	})
+
+	r.p.updateCollectorsCount()
+
+	r.log.Debug("registry was successfully dropped", zap.String("name", name))
+
+	*ok = true
+	return nil
+}
+
+// SetEnabled mutes or unmutes the collector, e.g. for a noisy maintenance window. A disabled collector stays
+// registered and keeps accepting the updates, it is only skipped by the scrapes (and the Gather RPC), so on re-enable
+// it reappears with the accumulated values. The state is not preserved when the collector is replaced on Reload.
+func (r *rpc) SetEnabled(s *CollectorState, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_set_enabled")
+	defer r.p.selfMetrics.observeRPC("set_enabled", time.Now(), &err)
+
+	c, exist := r.p.collectors.Load(s.Name)
+	if !exist {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", s.Name)))
+	}
+
+	// the family names are computed once here rather than collected on every scrape
+	col := c.(*collector)
+	if s.Enabled {
+		col.disabled.Store(nil)
+	} else {
+		names := r.p.familyNames(s.Name, col)
+		col.disabled.Store(&names)
+	}
+
+	r.log.Debug("collector exposition was toggled", zap.String("name", s.Name), zap.Bool("enabled", s.Enabled))
+
+	*ok = true
+	return nil
+}
+
+// Set the metric value (only for gauge and gauge_func), or replace the label set of the info. With require_label_map
+// the labels of the vector gauge should be keyed by the names.
+func (r *rpc) Set(m *Metric, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_set")
+	defer r.p.selfMetrics.observeRPC("set", time.Now(), &err)
+
+	r.log.Debug("setting metric", zap.String("name", m.Name), zap.Float64("value", m.Value), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Gauge)
+	if !exist {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
+	}
+	if c == nil {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
+	}
+
+	col := c.(*collector)
+
+	switch c := col.col.(type) {
+	case prometheus.Gauge:
+		c.Set(m.Value)
+
+	case *prometheus.GaugeVec:
+		if err := r.p.checkLabelMap(m); err != nil {
+			return errors.E(op, err)
+		}
+
+		gauge, err := child[prometheus.Gauge](c, col, m)
 		if err != nil {
-			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), zap.Strings("labels", m.Labels))
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
 			return errors.E(op, err)
 		}
 		gauge.Set(m.Value)
 
+	case *gaugeFunc:
+		c.Set(m.Value)
+
+	case *info:
+		// the value of the info is always 1, the labels replace the exposed label set
+		if err := col.matchLabelMap(m); err != nil {
+			return errors.E(op, err)
+		}
+
+		values := col.labelValues(m)
+		err := c.Set(values)
+		if err != nil {
+			if col.redactLabels {
+				err = errors.Errorf("invalid label values %s for collector %s", col.describe(values), m.Name)
+			}
+
+			return errors.E(op, withCode(CodeInvalidLabels, err))
+		}
+
+	default:
+		return errors.E(op, unsupported(col, m.Name, "Set"))
+	}
+
+	col.touch(m)
+	r.p.mirror(col, m, statsdSet, m.Value)
+
+	r.log.Debug("set operation finished successfully", zap.String("name", m.Name), r.labels(m), zap.Float64("value", m.Value))
+
+	*ok = true
+	return nil
+}
+
+// checkLabelValues rejects the empty and whitespace-only label values when strict_labels is enabled.
+func (p *Plugin) checkLabelValues(m *Metric) error {
+	if !p.cfg.StrictLabels {
+		return nil
+	}
+
+	for i, v := range m.Labels {
+		if strings.TrimSpace(v) == "" {
+			return withCode(CodeInvalidLabels, errors.Errorf("label value #%d is empty", i))
+		}
+	}
+
+	for name, v := range m.LabelMap {
+		if strings.TrimSpace(v) == "" {
+			return withCode(CodeInvalidLabels, errors.Errorf("value of the label %s is empty", name))
+		}
+	}
+
+	return nil
+}
+
+// labels is the log field of the label values, only their number when log_labels is disabled.
+func (r *rpc) labels(m *Metric) zap.Field {
+	if r.p.cfg.logLabels() {
+		return zap.Strings("labels", m.Labels)
+	}
+
+	return zap.Int("labels", max(len(m.Labels), len(m.LabelMap)))
+}
+
+// checkLabelMap rejects the positional label values with require_label_map. The positional values in the wrong order
+// update a wrong series silently, which is the most damaging for the absolute values of Set and Sub.
+func (p *Plugin) checkLabelMap(m *Metric) error {
+	if !p.cfg.RequireLabelMap || len(m.LabelMap) != 0 {
+		return nil
+	}
+
+	return withCode(CodeInvalidLabels, errors.Errorf("labels of collector %s should be keyed by the names (label_map), require_label_map is set", m.Name))
+}
+
+// vector is implemented by the vector collectors with the children of type T.
+type vector[T any] interface {
+	GetMetricWithLabelValues(lvs ...string) (T, error)
+	GetMetricWith(labels prometheus.Labels) (T, error)
+}
+
+// child resolves the child of the vector collector. The label map takes precedence over the positional labels,
+// prometheus validates it against the declared label names.
+func child[T any](vec vector[T], col *collector, m *Metric) (T, error) {
+	var zero T
+	if len(m.LabelMap) == 0 && len(m.Labels) == 0 {
+		return zero, withCode(CodeInvalidLabels, errors.Errorf("required labels for collector %s", m.Name))
+	}
+
+	if err := col.matchLabelMap(m); err != nil {
+		return zero, err
+	}
+
+	values := col.labelValues(m)
+	if len(m.LabelMap) != 0 && len(m.Labels) != 0 && !slices.Equal(m.Labels, values) {
+		if col.redactLabels {
+			return zero, withCode(CodeInvalidLabels, errors.Errorf("labels conflict with the label map for collector %s", m.Name))
+		}
+
+		return zero, withCode(CodeInvalidLabels, errors.Errorf("labels %v conflict with the label map %v for collector %s", m.Labels, m.LabelMap, m.Name))
+	}
+
+	added, err := col.admit(values)
+	if err != nil {
+		return zero, withCode(CodeCardinalityLimit, errors.Errorf("collector %s: %v", m.Name, err))
+	}
+
+	var t T
+	if len(m.LabelMap) != 0 {
+		t, err = vec.GetMetricWith(m.LabelMap)
+	} else {
+		t, err = vec.GetMetricWithLabelValues(m.Labels...)
+	}
+
+	if err != nil {
+		if added {
+			col.forget(values)
+		}
+
+		if col.redactLabels {
+			// the prometheus errors quote the label values
+			return zero, withCode(CodeInvalidLabels, errors.Errorf("invalid label values %s for collector %s", col.describe(values), m.Name))
+		}
+
+		return zero, withCode(CodeInvalidLabels, err)
+	}
+
+	return t, nil
+}
+
+// unsupported reports the method the collector does not support, with a hint to the method which fits its type,
+// e.g. Add called on a histogram is a common mistake.
+func unsupported(col *collector, name, method string) error {
+	if len(col.def.Const) != 0 {
+		return withCode(CodeUnsupportedMethod, errors.Errorf("collector `%s` is const, its samples can't be changed", name))
+	}
+
+	var hint string
+	switch col.def.Type {
+	case Histogram, Summary:
+		hint = "use `Observe` to record a value"
+	case Counter:
+		hint = "use `Add` or `Inc`, counters only go up"
+	case Gauge:
+		hint = "use `Set`, `Add` or `Sub`"
+	case GaugeFunc:
+		hint = "use `Set`"
+	case Info:
+		hint = "use `Set` to replace the label set"
+	}
+
+	if hint == "" {
+		return withCode(CodeUnsupportedMethod, errors.Errorf("collector `%s` does not support method `%s`", name, method))
+	}
+
+	return withCode(CodeUnsupportedMethod, errors.Errorf("collector `%s` of type %s does not support method `%s`, %s", name, col.def.Type, method, hint))
+}
+
+// addWithExemplar adds the value to the counter, attaching the exemplar when one is provided.
+func addWithExemplar(c prometheus.Counter, m *Metric) error {
+	if len(m.Exemplar) == 0 {
+		c.Add(m.Value)
+		return nil
+	}
+
+	adder, ok := c.(prometheus.ExemplarAdder)
+	if !ok {
+		return withCode(CodeInvalidExemplar, errors.Errorf("collector %s does not support exemplars", m.Name))
+	}
+
+	err := validateExemplar(m.Exemplar)
+	if err != nil {
+		return withCode(CodeInvalidExemplar, err)
+	}
+
+	adder.AddWithExemplar(m.Value, m.Exemplar)
+	return nil
+}
+
+// observeWithExemplar observes the value, attaching the exemplar when one is provided.
+func observeWithExemplar(o prometheus.Observer, m *Metric) error {
+	if len(m.Exemplar) == 0 {
+		o.Observe(m.Value)
+		return nil
+	}
+
+	observer, ok := o.(prometheus.ExemplarObserver)
+	if !ok {
+		return withCode(CodeInvalidExemplar, errors.Errorf("collector %s does not support exemplars", m.Name))
+	}
+
+	err := validateExemplar(m.Exemplar)
+	if err != nil {
+		return withCode(CodeInvalidExemplar, err)
+	}
+
+	observer.ObserveWithExemplar(m.Value, m.Exemplar)
+	return nil
+}
+
+// validateExemplar checks the exemplar labels up front, prometheus panics on invalid ones.
+func validateExemplar(labels map[string]string) error {
+	var runes int
+	for name, value := range labels {
+		if !model.LabelName(name).IsValidLegacy() {
+			return errors.Errorf("exemplar label name %q is invalid", name)
+		}
+
+		if !utf8.ValidString(value) {
+			return errors.Errorf("exemplar label value %q is not valid UTF-8", value)
+		}
+
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+
+	if runes > prometheus.ExemplarMaxRunes {
+		return errors.Errorf("exemplar labels have %d runes, exceeding the limit of %d", runes, prometheus.ExemplarMaxRunes)
+	}
+
+	return nil
+}
+
+// Gather returns the current state of all metrics in the Prometheus text exposition format.
+// The payload might be large, it is limited to maxGatherSize bytes.
+func (r *rpc) Gather(_ struct{}, out *[]byte) (err error) {
+	const op = errors.Op("metrics_plugin_gather")
+	defer r.p.selfMetrics.observeRPC("gather", time.Now(), &err)
+
+	mfs, err := r.p.gatherer().Gather()
+	if err != nil {
+		// gather errors are not fatal, the families that were gathered are still returned
+		r.log.Warn("failed to gather some metrics", zap.Error(err))
+	}
+
+	buf := &limitedBuffer{limit: maxGatherSize}
+	enc := expfmt.NewEncoder(buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		err = enc.Encode(mf)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	*out = buf.Bytes()
+	return nil
+}
+
+// limitedBuffer fails the writes exceeding the limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errors.Errorf("gathered metrics exceed %d bytes", b.limit)
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// Reload applies the collect section and the groups of the request, see Plugin.ReloadCollectors. An empty request (with
+// neither collect nor groups set) re-reads the section held by the configuration plugin instead, see Plugin.Reload.
+func (r *rpc) Reload(req *ReloadRequest, ok *bool) (err error) {
+	defer r.p.selfMetrics.observeRPC("reload", time.Now(), &err)
+
+	if req == nil || (req.Collect == nil && req.Groups == nil) {
+		err = r.p.Reload()
+	} else {
+		err = r.p.ReloadCollectors(req.Collect, req.Groups)
+	}
+	if err != nil {
+		return err
+	}
+
+	*ok = true
+	return nil
+}
+
+// List returns all collectors declared via configuration and RPC, sorted by name.
+func (r *rpc) List(_ struct{}, out *[]CollectorInfo) (err error) {
+	defer r.p.selfMetrics.observeRPC("list", time.Now(), &err)
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	// snapshot the collectors, so the reply does not share state with the map
+	infos := make([]CollectorInfo, 0, 10)
+	r.p.collectors.Range(func(key, value any) bool {
+		col := value.(*collector)
+		infos = append(infos, CollectorInfo{
+			Name:       key.(string),
+			Type:       col.def.Type,
+			Namespace:  col.def.Namespace,
+			Subsystem:  col.def.Subsystem,
+			Labels:     slices.Clone(col.def.Labels),
+			Registered: col.registered,
+			Owner:      col.owner,
+			Disabled:   col.disabled.Load() != nil,
+		})
+
+		return true
+	})
+
+	slices.SortFunc(infos, func(a, b CollectorInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	*out = infos
+	return nil
+}
+
+// SetEnum sets the series of the active state of the enum gauge to the value (1 when zero) and zeroes the series of
+// the other states with the same labels, so a state transition is a single call. The labels are the values of all
+// labels but the enum one, in the declared order, or a label map without the enum label.
+func (r *rpc) SetEnum(m *EnumMetric, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_set_enum")
+	defer r.p.selfMetrics.observeRPC("set_enum", time.Now(), &err)
+
+	r.log.Debug("setting enum state", zap.String("name", m.Name), zap.String("state", m.State), r.labels(&m.Metric))
+
+	if err := r.p.checkLabelValues(&m.Metric); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.p.collectors.Load(m.Name)
+	if !exist {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
+	}
+
+	col := c.(*collector)
+	vec, isVec := col.col.(*prometheus.GaugeVec)
+	enum := col.def.Enum
+	if !isVec || enum == nil {
+		return errors.E(op, withCode(CodeUnsupportedMethod, errors.Errorf("collector %s is not an enum gauge, declare it with enum", m.Name)))
+	}
+
+	if !slices.Contains(enum.States, m.State) {
+		return errors.E(op, withCode(CodeInvalidValue, errors.Errorf("unknown state %s of collector %s, should be one of %v", m.State, m.Name, enum.States)))
+	}
+
+	value := m.Value
+	if value == 0 {
+		value = 1
+	}
+
+	pos := slices.Index(col.def.Labels, enum.Label)
+	if len(m.LabelMap) == 0 && len(m.Labels) != len(col.def.Labels)-1 {
+		return errors.E(op, withCode(CodeInvalidLabels, errors.Errorf("collector %s requires the values of the labels %v except %s", m.Name, col.def.Labels, enum.Label)))
+	}
+
+	// the other states are zeroed first, so the scrape never sees two active states
+	states := slices.DeleteFunc(slices.Clone(enum.States), func(s string) bool { return s == m.State })
+	states = append(states, m.State)
+
+	col.enumMu.Lock()
+	defer col.enumMu.Unlock()
+
+	// all state series are admitted before any is changed, so a rejected one (e.g. by max_cardinality) keeps
+	// the previous state active instead of leaving all states zeroed
+	metrics := make([]Metric, len(states))
+	gauges := make([]prometheus.Gauge, len(states))
+	for i, state := range states {
+		sm := m.Metric
+		if len(m.LabelMap) != 0 {
+			sm.LabelMap = maps.Clone(m.LabelMap)
+			sm.LabelMap[enum.Label] = state
+			sm.Labels = nil
+		} else {
+			sm.Labels = slices.Insert(slices.Clone(m.Labels), pos, state)
+		}
+
+		gauge, err := child[prometheus.Gauge](vec, col, &sm)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		sm.Value = 0
+		if state == m.State {
+			sm.Value = value
+		}
+
+		metrics[i], gauges[i] = sm, gauge
+	}
+
+	for i := range states {
+		gauges[i].Set(metrics[i].Value)
+		col.touch(&metrics[i])
+		r.p.mirror(col, &metrics[i], statsdSet, metrics[i].Value)
+	}
+
+	*ok = true
+	return nil
+}
+
+// SetToCurrentTime sets the gauge to the current unix time in seconds using the plugin clock (gauge only).
+func (r *rpc) SetToCurrentTime(m *Metric, ok *bool) (err error) {
+	const op = errors.Op("metrics_plugin_set_to_current_time")
+	defer r.p.selfMetrics.observeRPC("set_to_current_time", time.Now(), &err)
+
+	r.log.Debug("setting metric to the current time", zap.String("name", m.Name), r.labels(m))
+
+	if err := r.p.checkLabelValues(m); err != nil {
+		return errors.E(op, err)
+	}
+
+	c, exist := r.load(m, Gauge)
+	if !exist {
+		return errors.E(op, withCode(CodeUndefinedCollector, errors.Errorf("undefined collector %s", m.Name)))
+	}
+
+	col := c.(*collector)
+
+	switch c := col.col.(type) {
+	case prometheus.Gauge:
+		c.SetToCurrentTime()
+
+	case *prometheus.GaugeVec:
+		gauge, err := child[prometheus.Gauge](c, col, m)
+		if err != nil {
+			r.log.Error("failed to get metrics with label values", zap.String("collector", m.Name), r.labels(m))
+			return errors.E(op, err)
+		}
+		gauge.SetToCurrentTime()
+
 	default:
-		return errors.E(op, errors.Errorf("collector `%s` does not support method Set", m.Name))
+		return errors.E(op, unsupported(col, m.Name, "SetToCurrentTime"))
 	}
 
-	r.log.Debug("set operation finished successfully", zap.String("name", m.Name), zap.Strings("labels", m.Labels), zap.Float64("value", m.Value))
+	col.touch(m)
+
+	r.log.Debug("set to current time operation finished successfully", zap.String("name", m.Name), r.labels(m))
 
 	*ok = true
 	return nil
@@ -1,12 +1,25 @@
 package metrics
 
 import (
+	stderr "errors"
+	"fmt"
+	"math"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/goccy/go-json"
-
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 type unmarshal func([]byte, any) error
@@ -64,3 +77,1109 @@ func Test_Metric_Unmarshal(t *testing.T) {
 		})
 	}
 }
+
+func newTestRPC(t *testing.T) *rpc {
+	t.Helper()
+
+	p := newTestPlugin(&Config{})
+	return &rpc{
+		p:   p,
+		log: p.log,
+	}
+}
+
+func Test_RPC_Exemplars(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "in_flight", Collector: Collector{Type: Gauge}}, &ok))
+
+	exemplar := map[string]string{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"}
+
+	assert.NoError(t, r.Observe(&Metric{Name: "latency", Value: 0.2, Exemplar: exemplar}, &ok))
+	assert.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Exemplar: exemplar}, &ok))
+	assert.Error(t, r.Add(&Metric{Name: "in_flight", Value: 1, Exemplar: exemplar}, &ok))
+
+	tooLong := map[string]string{"trace_id": strings.Repeat("a", prometheus.ExemplarMaxRunes)}
+	assert.Error(t, r.Observe(&Metric{Name: "latency", Value: 0.2, Exemplar: tooLong}, &ok))
+	assert.Error(t, r.Observe(&Metric{Name: "latency", Value: 0.2, Exemplar: map[string]string{"0invalid": "x"}}, &ok))
+}
+
+func Test_RPC_GlobalLabels(t *testing.T) {
+	r := newTestRPC(t)
+	r.p.registerer = prometheus.WrapRegistererWith(prometheus.Labels{"app": "testapp", "env": "testenv"}, r.p.registry)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Labels: []string{"type"}}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"get"}}, &ok))
+
+	families, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+
+	labels := make(map[string]string)
+	for _, lp := range families[0].GetMetric()[0].GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+
+	assert.Equal(t, map[string]string{"app": "testapp", "env": "testenv", "type": "get"}, labels)
+
+	require.NoError(t, r.Unregister("requests", &ok))
+	assert.True(t, ok)
+}
+
+func Test_RPC_GaugeFunc(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue_depth", Collector: Collector{Type: GaugeFunc}}, &ok))
+	require.NoError(t, r.Set(&Metric{Name: "queue_depth", Value: 42}, &ok))
+	assert.Error(t, r.Add(&Metric{Name: "queue_depth", Value: 1}, &ok))
+
+	families, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	assert.Equal(t, float64(42), families[0].GetMetric()[0].GetGauge().GetValue())
+
+	err = r.Declare(&NamedCollector{Name: "queue_depth_vec", Collector: Collector{Type: GaugeFunc, Labels: []string{"queue"}}}, &ok)
+	assert.Error(t, err)
+}
+
+func Test_RPC_SelfMetrics(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Namespace: "app"}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1}, &ok))
+	require.Error(t, r.Add(&Metric{Name: "undefined", Value: 1}, &ok))
+	var infos []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &infos))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.rpcCalls.WithLabelValues("list", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.rpcCalls.WithLabelValues("add", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.rpcCalls.WithLabelValues("add", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.rpcCalls.WithLabelValues("declare", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.registeredCollectors))
+
+	// same fully qualified name under a different collector name
+	require.Error(t, r.Declare(&NamedCollector{Name: "app_requests", Collector: Collector{Type: Counter}}, &ok))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.declareErrors))
+
+	require.NoError(t, r.Unregister("requests", &ok))
+	assert.Equal(t, float64(0), testutil.ToFloat64(r.p.selfMetrics.registeredCollectors))
+}
+
+func Test_SelfMetrics_BuildInfo(t *testing.T) {
+	s := newSelfMetrics()
+
+	assert.Equal(t, "unknown", Version)
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.buildInfo.WithLabelValues("unknown", runtime.Version())))
+}
+
+func Test_RPC_DeclarePanic(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Namespace: "app", Help: "Requests."}}, &ok))
+
+	// same fully qualified name with an incompatible help string
+	err := r.Declare(&NamedCollector{Name: "app_requests", Collector: Collector{Type: Counter, Help: "Other help."}}, &ok)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	// prometheus panics on the reserved `le` label in histograms
+	err = r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, ConstLabels: map[string]string{"le": "1"}}}, &ok)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	// the plugin is still alive
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1}, &ok))
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), testutil.ToFloat64(r.p.selfMetrics.declareErrors))
+}
+
+func Test_RPC_DeclareBatch(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+
+	err := r.DeclareBatch([]*NamedCollector{
+		{Name: "requests", Collector: Collector{Type: Counter}},
+		{Name: "latency", Collector: Collector{Type: Histogram}},
+		{Name: "broken", Collector: Collector{Type: "unknown"}},
+		{Name: "queue", Collector: Collector{Type: Gauge, Labels: []string{"name"}}},
+	}, &ok)
+	assert.ErrorContains(t, err, "broken")
+	assert.NotContains(t, err.Error(), "latency")
+	assert.False(t, ok)
+
+	var out []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &out))
+	require.Len(t, out, 3)
+	assert.Equal(t, "latency", out[0].Name)
+	assert.Equal(t, "queue", out[1].Name)
+	assert.Equal(t, "requests", out[2].Name)
+
+	require.NoError(t, r.DeclareBatch([]*NamedCollector{{Name: "latency", Collector: Collector{Type: Histogram}}}, &ok))
+	assert.True(t, ok)
+}
+
+func Test_RPC_List(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Namespace: "app", Labels: []string{"method"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, Subsystem: "http"}}, &ok))
+
+	var out []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &out))
+	assert.Equal(t, []CollectorInfo{
+		{Name: "latency", Type: Histogram, Subsystem: "http", Registered: true},
+		{Name: "requests", Type: Counter, Namespace: "app", Labels: []string{"method"}, Registered: true},
+	}, out)
+}
+
+func Test_RPC_UnregisterAll(t *testing.T) {
+	r := newTestRPC(t)
+	require.NoError(t, r.p.Register(collectors.NewGoCollector()))
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram}}, &ok))
+
+	ok = false
+	require.NoError(t, r.UnregisterAll(struct{}{}, &ok))
+	assert.True(t, ok)
+
+	var out []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &out))
+	assert.Empty(t, out)
+
+	families, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		assert.True(t, strings.HasPrefix(mf.GetName(), "go_"), mf.GetName())
+	}
+
+	// names can be declared again
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+
+	// the collector which fails to unregister is kept
+	stray := prometheus.NewCounter(prometheus.CounterOpts{Name: "stray", Help: "Stray."})
+	r.p.collectors.Store("stray", wrapCollector(stray, &Collector{Type: Counter}, true))
+
+	ok = false
+	err = r.UnregisterAll(struct{}{}, &ok)
+	assert.Equal(t, CodeRegistry, Code(err))
+	assert.ErrorContains(t, err, "stray")
+	assert.False(t, ok)
+
+	require.NoError(t, r.List(struct{}{}, &out))
+	require.Len(t, out, 1)
+	assert.Equal(t, "stray", out[0].Name)
+	require.NoError(t, r.Inc("stray", &ok))
+}
+
+func Test_RPC_ObserveDuration(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency_seconds", Collector: Collector{Type: Histogram, Buckets: []float64{0.5, 1, 5}}}, &ok))
+
+	ok = false
+	require.NoError(t, r.ObserveDuration(&Metric{Name: "latency_seconds", Value: float64(time.Millisecond * 250)}, &ok))
+	assert.True(t, ok)
+	require.NoError(t, r.ObserveDuration(&Metric{Name: "latency_seconds", Start: time.Now().Add(-time.Second * 2).UnixNano()}, &ok))
+	assert.Error(t, r.ObserveDuration(&Metric{Name: "latency_seconds", Value: -1}, &ok))
+
+	families, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	h := families[0].GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(2), h.GetSampleCount())
+	// 0.25s lands in the first bucket, ~2s in the last one
+	assert.Equal(t, uint64(1), h.GetBucket()[0].GetCumulativeCount())
+	assert.Equal(t, uint64(1), h.GetBucket()[1].GetCumulativeCount())
+	assert.Equal(t, uint64(2), h.GetBucket()[2].GetCumulativeCount())
+}
+
+func Test_RPC_SetToCurrentTime(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "last_success_timestamp_seconds", Collector: Collector{Type: Gauge, Labels: []string{"job"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter}}, &ok))
+
+	before := float64(time.Now().Unix())
+	require.NoError(t, r.SetToCurrentTime(&Metric{Name: "last_success_timestamp_seconds", Labels: []string{"cron"}}, &ok))
+	assert.Error(t, r.SetToCurrentTime(&Metric{Name: "last_success_timestamp_seconds"}, &ok))
+	assert.Error(t, r.SetToCurrentTime(&Metric{Name: "jobs_total"}, &ok))
+
+	c, _ := r.p.collectors.Load("last_success_timestamp_seconds")
+	value := testutil.ToFloat64(c.(*collector).col.(*prometheus.GaugeVec).WithLabelValues("cron"))
+	assert.GreaterOrEqual(t, value, before)
+}
+
+// expireSeries backdates the update of the series beyond the TTL, the background sweep may run concurrently.
+func expireSeries(s *seriesTTL, labels ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSeen[seriesKey(labels)] = series{labels: labels, updated: time.Now().Add(-s.ttl * 2)}
+}
+
+func Test_RPC_TTL(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "tenant_requests", Collector: Collector{Type: Counter, Labels: []string{"tenant"}, TTL: time.Minute}}, &ok))
+	t.Cleanup(func() {
+		require.NoError(t, r.UnregisterAll(struct{}{}, &ok))
+	})
+
+	require.NoError(t, r.Add(&Metric{Name: "tenant_requests", Value: 1, Labels: []string{"gone"}}, &ok))
+	c, _ := r.p.collectors.Load("tenant_requests")
+	col := c.(*collector)
+	require.NotNil(t, col.ttl)
+	assert.Equal(t, time.Second*30, col.ttl.interval)
+
+	// the first series was updated before the TTL, so only it expires
+	expireSeries(col.ttl, "gone")
+	require.NoError(t, r.Add(&Metric{Name: "tenant_requests", Value: 1, Labels: []string{"active"}}, &ok))
+	col.ttl.sweep(time.Now())
+
+	assert.Equal(t, 1, testutil.CollectAndCount(col.col))
+	assert.Equal(t, float64(1), testutil.ToFloat64(col.col.(*prometheus.CounterVec).WithLabelValues("active")))
+
+	err := r.Declare(&NamedCollector{Name: "plain", Collector: Collector{Type: Counter, TTL: time.Minute}}, &ok)
+	assert.ErrorContains(t, err, "requires labels")
+}
+
+func Test_RPC_MaxCardinality(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{
+		Type:           Counter,
+		Labels:         []string{"id"},
+		MaxCardinality: 2,
+		TTL:            time.Minute,
+	}}, &ok))
+	t.Cleanup(func() {
+		require.NoError(t, r.UnregisterAll(struct{}{}, &ok))
+	})
+
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"1"}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, LabelMap: map[string]string{"id": "2"}}, &ok))
+	assert.ErrorContains(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"3"}}, &ok), "max_cardinality")
+
+	// the existing series are still updated
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"1"}}, &ok))
+	c, _ := r.p.collectors.Load("requests")
+	col := c.(*collector)
+	assert.Equal(t, 2, testutil.CollectAndCount(col.col))
+
+	// the series rejected by prometheus is not accounted
+	require.Error(t, r.Add(&Metric{Name: "requests", Value: 1, LabelMap: map[string]string{"unknown": "1"}}, &ok))
+	assert.Len(t, col.series, 2)
+
+	// the expired series frees the slot
+	expireSeries(col.ttl, "1")
+	col.ttl.sweep(time.Now())
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"3"}}, &ok))
+
+	err := r.Declare(&NamedCollector{Name: "plain", Collector: Collector{Type: Counter, MaxCardinality: 1}}, &ok)
+	assert.ErrorContains(t, err, "requires labels")
+}
+
+func Test_RPC_CardinalityWarning(t *testing.T) {
+	r := newTestRPC(t)
+	r.p.cfg.CardinalityWarningRatio = 0.5
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Labels: []string{"id"}, MaxCardinality: 4}}, &ok))
+
+	warnings := r.p.selfMetrics.highCardinality.WithLabelValues("requests")
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"1"}}, &ok))
+	assert.Zero(t, testutil.ToFloat64(warnings))
+
+	// reported once, when the second series crosses the half of the cap
+	for _, id := range []string{"2", "3", "4"} {
+		require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{id}}, &ok))
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(warnings))
+}
+
+func Test_RPC_Info(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "build_info", Collector: Collector{
+		Type:   Info,
+		Labels: []string{"version", "commit"},
+		Info:   map[string]string{"version": "1.0.0", "commit": "abc"},
+	}}, &ok))
+
+	c, _ := r.p.collectors.Load("build_info")
+	col := c.(*collector).col.(*info)
+	assert.Equal(t, float64(1), testutil.ToFloat64(col.WithLabelValues("1.0.0", "abc")))
+
+	// the new label set replaces the old one
+	require.NoError(t, r.Set(&Metric{Name: "build_info", Labels: []string{"1.1.0", "def"}}, &ok))
+	assert.Equal(t, 1, testutil.CollectAndCount(col))
+	assert.Equal(t, float64(1), testutil.ToFloat64(col.WithLabelValues("1.1.0", "def")))
+
+	assert.Error(t, r.Set(&Metric{Name: "build_info", Labels: []string{"1.2.0"}}, &ok))
+
+	// a typo in the label name is not turned into an empty value
+	err := r.Set(&Metric{Name: "build_info", LabelMap: map[string]string{"version": "1.2.0", "comit": "ghi"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+	assert.Equal(t, float64(1), testutil.ToFloat64(col.WithLabelValues("1.1.0", "def")))
+
+	err = r.Declare(&NamedCollector{Name: "app_info", Collector: Collector{Type: Info, Labels: []string{"version"}, Info: map[string]string{"commit": "abc"}}}, &ok)
+	assert.ErrorContains(t, err, "version")
+
+	// the series guards do not apply to the info, its label set is replaced as a whole
+	err = r.Declare(&NamedCollector{Name: "app_info", Collector: Collector{Type: Info, Labels: []string{"version"}, MaxCardinality: 2}}, &ok)
+	assert.ErrorContains(t, err, "max_cardinality")
+	err = r.Declare(&NamedCollector{Name: "app_info", Collector: Collector{Type: Info, Labels: []string{"version"}, TTL: time.Minute}}, &ok)
+	assert.ErrorContains(t, err, "ttl")
+}
+
+func Test_RPC_Inc(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "events", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue", Collector: Collector{Type: Gauge, Labels: []string{"name"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram}}, &ok))
+
+	require.NoError(t, r.Inc("events", &ok))
+	require.NoError(t, r.Inc("events", &ok))
+	require.NoError(t, r.IncLabels(&Metric{Name: "queue", Value: 10, Labels: []string{"default"}}, &ok))
+	assert.True(t, ok)
+
+	c, _ := r.p.collectors.Load("events")
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.(*collector).col))
+	c, _ = r.p.collectors.Load("queue")
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.(*collector).col.(*prometheus.GaugeVec).WithLabelValues("default")))
+
+	assert.Error(t, r.Inc("queue", &ok))
+	assert.ErrorContains(t, r.Inc("latency", &ok), "does not support")
+	assert.Error(t, r.Inc("unknown", &ok))
+}
+
+func Test_RPC_StrictLabels(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Labels: []string{"method", "status"}}}, &ok))
+
+	// empty values are allowed by default
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET", ""}}, &ok))
+
+	r.p.cfg.StrictLabels = true
+	err := r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET", " "}}, &ok)
+	assert.ErrorContains(t, err, "#1")
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET", "200"}}, &ok))
+}
+
+func Test_RPC_LabelMap(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Labels: []string{"method", "status"}}}, &ok))
+
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, LabelMap: map[string]string{"status": "200", "method": "GET"}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET", "200"}, LabelMap: map[string]string{"status": "200", "method": "GET"}}, &ok))
+
+	c, _ := r.p.collectors.Load("requests")
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.(*collector).col.(*prometheus.CounterVec).WithLabelValues("GET", "200")))
+
+	err := r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"200", "GET"}, LabelMap: map[string]string{"status": "200", "method": "GET"}}, &ok)
+	assert.ErrorContains(t, err, "conflict")
+
+	err = r.Add(&Metric{Name: "requests", Value: 1, LabelMap: map[string]string{"code": "200", "method": "GET"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+
+	err = r.Add(&Metric{Name: "requests", Value: 1, LabelMap: map[string]string{"method": "GET"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+}
+
+func Test_RPC_Gather(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests_total", Collector: Collector{Type: Counter, Help: "Requests."}}, &ok))
+	require.NoError(t, r.Inc("requests_total", &ok))
+
+	var out []byte
+	require.NoError(t, r.Gather(struct{}{}, &out))
+	assert.Contains(t, string(out), "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total 1\n")
+
+	buf := &limitedBuffer{limit: 4}
+	_, err := buf.Write([]byte("12345"))
+	assert.Error(t, err)
+}
+
+func Test_RPC_UnsupportedHint(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue", Collector: Collector{Type: Gauge}}, &ok))
+
+	assert.ErrorContains(t, r.Add(&Metric{Name: "latency", Value: 1}, &ok), "use `Observe`")
+	assert.ErrorContains(t, r.Sub(&Metric{Name: "latency", Value: 1}, &ok), "use `Observe`")
+	assert.ErrorContains(t, r.Set(&Metric{Name: "latency", Value: 1}, &ok), "use `Observe`")
+	assert.ErrorContains(t, r.Observe(&Metric{Name: "requests", Value: 1}, &ok), "use `Add`")
+	assert.ErrorContains(t, r.Observe(&Metric{Name: "queue", Value: 1}, &ok), "use `Set`")
+}
+
+func Test_RPC_ErrorCodes(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	err := r.Add(&Metric{Name: "requests", Value: 1}, &ok)
+	assert.Equal(t, CodeUndefinedCollector, Code(err))
+	assert.Contains(t, err.Error(), "[undefined_collector]")
+
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, Labels: []string{"method"}, MaxCardinality: 1}}, &ok))
+	assert.Equal(t, CodeInvalidLabels, Code(r.Add(&Metric{Name: "requests", Value: 1}, &ok)))
+	assert.Equal(t, CodeInvalidLabels, Code(r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET", "extra"}}, &ok)))
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"GET"}}, &ok))
+	assert.Equal(t, CodeCardinalityLimit, Code(r.Add(&Metric{Name: "requests", Value: 1, Labels: []string{"POST"}}, &ok)))
+	assert.Equal(t, CodeUnsupportedMethod, Code(r.Sub(&Metric{Name: "requests", Value: 1, Labels: []string{"GET"}}, &ok)))
+	assert.Equal(t, CodeUnsupportedMethod, Code(r.Observe(&Metric{Name: "requests", Value: 1, Labels: []string{"GET"}}, &ok)))
+	assert.Equal(t, CodeUndefinedCollector, Code(r.Set(&Metric{Name: "queue", Value: 1}, &ok)))
+
+	assert.Equal(t, CodeInvalidCollector, Code(r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, Buckets: []float64{2, 1}}}, &ok)))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs", Collector: Collector{Type: Gauge, Namespace: "app"}}, &ok))
+	assert.Equal(t, CodeRegistry, Code(r.Declare(&NamedCollector{Name: "app_jobs", Collector: Collector{Type: Gauge}}, &ok)))
+	assert.Equal(t, CodeUndefinedCollector, Code(r.Unregister("queue", &ok)))
+
+	assert.Empty(t, Code(nil))
+	assert.Empty(t, Code(stderr.New("plain")))
+}
+
+func Test_RPC_AutoDeclare(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.Error(t, r.Add(&Metric{Name: "requests", Value: 1}, &ok))
+
+	r.p.cfg.AutoDeclare = true
+	require.NoError(t, r.Add(&Metric{Name: "requests", Value: 2}, &ok))
+	require.NoError(t, r.Observe(&Metric{Name: "latency", Value: 0.2, LabelMap: map[string]string{"method": "GET"}}, &ok))
+	require.NoError(t, r.Set(&Metric{Name: "queue", Value: 3}, &ok))
+
+	types := map[string]CollectorType{}
+	labels := map[string][]string{}
+	r.p.collectors.Range(func(key, value any) bool {
+		types[key.(string)] = value.(*collector).def.Type
+		labels[key.(string)] = value.(*collector).def.Labels
+		return true
+	})
+	assert.Equal(t, map[string]CollectorType{"requests": Counter, "latency": Histogram, "queue": Gauge}, types)
+	assert.Equal(t, []string{"method"}, labels["latency"])
+
+	c, _ := r.p.collectors.Load("requests")
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.(*collector).col))
+
+	// the names of the positional labels are unknown
+	assert.Equal(t, CodeUndefinedCollector, Code(r.Add(&Metric{Name: "jobs", Value: 1, Labels: []string{"GET"}}, &ok)))
+}
+
+func Test_RPC_MirrorAsHistogram(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{
+		Type:              Summary,
+		Help:              "Latency.",
+		Labels:            []string{"method"},
+		MirrorAsHistogram: &HistogramMirror{Buckets: []float64{0.1, 1}},
+	}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs", Collector: Collector{
+		Type:              Summary,
+		Help:              "Jobs.",
+		MirrorAsHistogram: &HistogramMirror{Suffix: "_hist"},
+	}}, &ok))
+
+	require.NoError(t, r.Observe(&Metric{Name: "latency", Value: 0.5, Labels: []string{"GET"}}, &ok))
+	require.NoError(t, r.Observe(&Metric{Name: "jobs", Value: 2}, &ok))
+
+	expected := `
+# HELP latency Latency.
+# TYPE latency summary
+latency_sum{method="GET"} 0.5
+latency_count{method="GET"} 1
+# HELP latency_histogram Latency.
+# TYPE latency_histogram histogram
+latency_histogram_bucket{method="GET",le="0.1"} 0
+latency_histogram_bucket{method="GET",le="1"} 1
+latency_histogram_bucket{method="GET",le="+Inf"} 1
+latency_histogram_sum{method="GET"} 0.5
+latency_histogram_count{method="GET"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "latency", "latency_histogram"))
+
+	n, err := testutil.GatherAndCount(r.p.registry, "jobs", "jobs_hist")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// both are unregistered together
+	require.NoError(t, r.Unregister("latency", &ok))
+	n, err = testutil.GatherAndCount(r.p.registry, "latency", "latency_histogram")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	err = r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter, MirrorAsHistogram: &HistogramMirror{}}}, &ok)
+	assert.ErrorContains(t, err, "only supported by summaries")
+}
+
+func Test_RPC_ForceNamespace(t *testing.T) {
+	r := newTestRPC(t)
+	r.p.cfg.ForceNamespace = "app"
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs", Collector: Collector{Type: Counter, Namespace: "app"}}, &ok))
+
+	err := r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, Namespace: "other"}}, &ok)
+	assert.ErrorContains(t, err, "force_namespace")
+	assert.Equal(t, CodeInvalidCollector, Code(err))
+
+	n, err := testutil.GatherAndCount(r.p.registry, "app_requests", "app_jobs")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Error(t, (&Config{ForceNamespace: "app-name"}).validate())
+}
+
+func Test_RPC_UnregisterRollback(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+
+	// the collector disappears from the prometheus registry behind the plugin back
+	c, _ := r.p.collectors.Load("requests")
+	require.True(t, r.p.registry.Unregister(c.(*collector).col))
+
+	ok = false
+	assert.Error(t, r.Unregister("requests", &ok))
+	assert.False(t, ok)
+
+	_, exist := r.p.collectors.Load("requests")
+	assert.True(t, exist)
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.p.selfMetrics.registeredCollectors))
+
+	// once consistent again, unregister succeeds
+	require.NoError(t, r.p.Register(c.(*collector).col))
+	require.NoError(t, r.Unregister("requests", &ok))
+	assert.True(t, ok)
+
+	_, exist = r.p.collectors.Load("requests")
+	assert.False(t, exist)
+}
+
+func Test_RPC_ObserveBulk(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, Buckets: []float64{0.1, 0.5, 1}, Labels: []string{"route"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+
+	bulk := &BulkObservation{
+		Metric:       Metric{Name: "latency", Labels: []string{"/"}},
+		Observations: []Observation{{Value: 0.1, Count: 3}, {Value: 1, Count: 2}},
+	}
+	require.NoError(t, r.ObserveBulk(bulk, &ok))
+	assert.True(t, ok)
+
+	expected := `
+# HELP latency 
+# TYPE latency histogram
+latency_bucket{route="/",le="0.1"} 3
+latency_bucket{route="/",le="0.5"} 3
+latency_bucket{route="/",le="1"} 5
+latency_bucket{route="/",le="+Inf"} 5
+latency_sum{route="/"} 2.3
+latency_count{route="/"} 5
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "latency"))
+
+	err := r.ObserveBulk(&BulkObservation{Metric: Metric{Name: "requests"}, Observations: []Observation{{Value: 1, Count: 1}}}, &ok)
+	assert.Equal(t, CodeUnsupportedMethod, Code(err))
+
+	err = r.ObserveBulk(&BulkObservation{Metric: Metric{Name: "latency", Labels: []string{"/"}}, Observations: []Observation{{Value: 1, Count: maxBulkObservations + 1}}}, &ok)
+	assert.Equal(t, CodeInvalidValue, Code(err))
+
+	// the counts wrapping around uint64 are rejected as well
+	err = r.ObserveBulk(&BulkObservation{Metric: Metric{Name: "latency", Labels: []string{"/"}}, Observations: []Observation{{Value: 1, Count: 1}, {Value: 1, Count: math.MaxUint64}}}, &ok)
+	assert.Equal(t, CodeInvalidValue, Code(err))
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "latency"))
+
+	err = r.ObserveBulk(&BulkObservation{Metric: Metric{Name: "missing"}, Observations: []Observation{{Value: 1, Count: 1}}}, &ok)
+	assert.Equal(t, CodeUndefinedCollector, Code(err))
+}
+
+func Test_RPC_Quantiles(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{Type: Histogram, Buckets: []float64{1, 2, 4}, Labels: []string{"route"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "size", Collector: Collector{Type: Summary, Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "requests", Collector: Collector{Type: Counter}}, &ok))
+
+	var out QuantileValues
+	// the series is not created by the read
+	require.NoError(t, r.Quantiles(&QuantileQuery{Metric: Metric{Name: "latency", Labels: []string{"/"}}}, &out))
+	assert.Equal(t, QuantileValues{Quantiles: []Quantile{}}, out)
+	n, err := testutil.GatherAndCount(r.p.registry, "latency")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// 2 observations in (0,1], 2 in (1,2]
+	require.NoError(t, r.ObserveBulk(&BulkObservation{
+		Metric:       Metric{Name: "latency", Labels: []string{"/"}},
+		Observations: []Observation{{Value: 0.5, Count: 2}, {Value: 1.5, Count: 2}},
+	}, &ok))
+
+	require.NoError(t, r.Quantiles(&QuantileQuery{Metric: Metric{Name: "latency", LabelMap: map[string]string{"route": "/"}}, Quantiles: []float64{0.75, 0.25}}, &out))
+	assert.Equal(t, uint64(4), out.Count)
+	assert.Equal(t, []Quantile{{Quantile: 0.25, Value: 0.5}, {Quantile: 0.75, Value: 1.5}}, out.Quantiles)
+
+	for range 10 {
+		require.NoError(t, r.Observe(&Metric{Name: "size", Value: 10}, &ok))
+	}
+
+	require.NoError(t, r.Quantiles(&QuantileQuery{Metric: Metric{Name: "size"}}, &out))
+	assert.Equal(t, uint64(10), out.Count)
+	assert.Equal(t, []Quantile{{Quantile: 0.5, Value: 10}, {Quantile: 0.9, Value: 10}}, out.Quantiles)
+
+	err = r.Quantiles(&QuantileQuery{Metric: Metric{Name: "size"}, Quantiles: []float64{0.99}}, &out)
+	assert.ErrorContains(t, err, "not an objective")
+
+	err = r.Quantiles(&QuantileQuery{Metric: Metric{Name: "latency"}}, &out)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+
+	err = r.Quantiles(&QuantileQuery{Metric: Metric{Name: "latency", Labels: []string{"/"}}, Quantiles: []float64{1.5}}, &out)
+	assert.Equal(t, CodeInvalidValue, Code(err))
+
+	err = r.Quantiles(&QuantileQuery{Metric: Metric{Name: "requests"}}, &out)
+	assert.Equal(t, CodeUnsupportedMethod, Code(err))
+}
+
+func Test_RPC_InitialValue(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "capacity", Collector: Collector{Type: Gauge, InitialValue: 16}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue_capacity", Collector: Collector{
+		Type:           Gauge,
+		Labels:         []string{"queue"},
+		InitialValue:   8,
+		InitialLabels:  [][]string{{"default"}, {"priority"}},
+		MaxCardinality: 2,
+	}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Labels: []string{"queue"}, InitialLabels: [][]string{{"default"}}}}, &ok))
+
+	expected := `
+# HELP capacity 
+# TYPE capacity gauge
+capacity 16
+# HELP jobs_total 
+# TYPE jobs_total counter
+jobs_total{queue="default"} 0
+# HELP queue_capacity 
+# TYPE queue_capacity gauge
+queue_capacity{queue="default"} 8
+queue_capacity{queue="priority"} 8
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "capacity", "jobs_total", "queue_capacity"))
+
+	// the initial series count against max_cardinality
+	err := r.Set(&Metric{Name: "queue_capacity", Value: 1, Labels: []string{"other"}}, &ok)
+	assert.Equal(t, CodeCardinalityLimit, Code(err))
+
+	for _, c := range []Collector{
+		{Type: Histogram, InitialValue: 1},
+		{Type: Counter, InitialValue: -1},
+		{Type: Gauge, InitialLabels: [][]string{{"a"}}},
+		{Type: Gauge, Labels: []string{"a", "b"}, InitialLabels: [][]string{{"a"}}},
+	} {
+		err := r.Declare(&NamedCollector{Name: "invalid", Collector: c}, &ok)
+		assert.Equal(t, CodeInvalidCollector, Code(err), c)
+	}
+}
+
+func Test_RPC_UnregisterByOwner(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "w1_jobs", Collector: Collector{Type: Counter}, Owner: "worker-1"}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "w1_queue", Collector: Collector{Type: Gauge}, Owner: "worker-1"}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "w2_jobs", Collector: Collector{Type: Counter}, Owner: "worker-2"}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "shared", Collector: Collector{Type: Counter}}, &ok))
+
+	var infos []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &infos))
+	require.Len(t, infos, 4)
+	assert.Equal(t, "worker-2", infos[3].Owner)
+
+	var count int
+	require.NoError(t, r.UnregisterByOwner("worker-1", &count))
+	assert.Equal(t, 2, count)
+
+	require.NoError(t, r.List(struct{}{}, &infos))
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	assert.Equal(t, []string{"shared", "w2_jobs"}, names)
+
+	require.NoError(t, r.UnregisterByOwner("worker-1", &count))
+	assert.Zero(t, count)
+
+	assert.Error(t, r.UnregisterByOwner("", &count))
+}
+
+func Test_RPC_RequireLabelMap(t *testing.T) {
+	r := newTestRPC(t)
+	r.p.cfg.RequireLabelMap = true
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue_size", Collector: Collector{Type: Gauge, Labels: []string{"queue", "pipeline"}}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Labels: []string{"queue"}}}, &ok))
+
+	err := r.Set(&Metric{Name: "queue_size", Value: 10, Labels: []string{"local", "default"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+	err = r.Sub(&Metric{Name: "queue_size", Value: 1, Labels: []string{"local", "default"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+
+	labels := map[string]string{"pipeline": "default", "queue": "local"}
+	require.NoError(t, r.Set(&Metric{Name: "queue_size", Value: 10, LabelMap: labels}, &ok))
+	require.NoError(t, r.Sub(&Metric{Name: "queue_size", Value: 1, LabelMap: labels}, &ok))
+
+	// a mismatch of the label names is reported
+	err = r.Set(&Metric{Name: "queue_size", Value: 10, LabelMap: map[string]string{"queue": "local", "pipe": "default"}}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+
+	// the other methods are not affected
+	require.NoError(t, r.Add(&Metric{Name: "jobs_total", Value: 1, Labels: []string{"local"}}, &ok))
+
+	expected := `
+# HELP queue_size 
+# TYPE queue_size gauge
+queue_size{pipeline="default",queue="local"} 9
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "queue_size"))
+}
+
+func Test_RPC_LogLabels(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	r := newTestRPC(t)
+	r.log = zap.New(core)
+	r.p.cfg.LogLabels = new(bool)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "logins", Collector: Collector{Type: Counter, Labels: []string{"email"}, MaxCardinality: 1}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "logins", Value: 1, Labels: []string{"jane@example.com"}}, &ok))
+
+	errs := []error{
+		r.Add(&Metric{Name: "logins", Value: 1, Labels: []string{"john@example.com"}}, &ok),
+		r.Add(&Metric{Name: "logins", Value: 1, Labels: []string{"jane@example.com", "x@example.com"}}, &ok),
+		r.Add(&Metric{Name: "logins", Value: 1, Labels: []string{"jane@example.com"}, LabelMap: map[string]string{"email": "x@example.com"}}, &ok),
+	}
+	for _, err := range errs {
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "@example.com")
+	}
+
+	require.NotZero(t, logs.Len())
+	for _, entry := range logs.All() {
+		for _, f := range entry.Context {
+			assert.NotContains(t, fmt.Sprint(f.Interface, f.String), "@example.com", entry.Message)
+		}
+	}
+
+	// logged by default
+	r.p.cfg.LogLabels = nil
+	require.NoError(t, r.Add(&Metric{Name: "logins", Value: 1, Labels: []string{"jane@example.com"}}, &ok))
+	assert.NotEmpty(t, logs.FilterField(zap.Strings("labels", []string{"jane@example.com"})).All())
+}
+
+func Test_RPC_ClassicAndNativeHistogram(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{
+		Type:                        Histogram,
+		Buckets:                     []float64{0.1, 1},
+		NativeHistogramBucketFactor: 1.1,
+	}}, &ok))
+	require.NoError(t, r.Observe(&Metric{Name: "latency", Value: 0.5}, &ok))
+
+	mfs, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+
+	// the scrapers of either capability get the data
+	h := mfs[0].GetMetric()[0].GetHistogram()
+	require.Len(t, h.GetBucket(), 2)
+	assert.Equal(t, uint64(1), h.GetBucket()[1].GetCumulativeCount())
+	assert.NotNil(t, h.Schema)
+	assert.NotEmpty(t, h.GetPositiveSpan())
+
+	// the collect section builds the same histogram
+	c := &Config{Collect: map[string]Collector{"latency": {Type: Histogram, Buckets: []float64{0.1, 1}, NativeHistogramBucketFactor: 1.1}}}
+	cols, err := c.getCollectors()
+	require.NoError(t, err)
+	cols["latency"].col.(prometheus.Histogram).Observe(0.5)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(cols["latency"].col))
+	mfs, err = reg.Gather()
+	require.NoError(t, err)
+	h = mfs[0].GetMetric()[0].GetHistogram()
+	assert.Len(t, h.GetBucket(), 2)
+	assert.NotEmpty(t, h.GetPositiveSpan())
+}
+
+func Test_RPC_SanitizeNames(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	assert.Error(t, r.Declare(&NamedCollector{Name: "http.requests", Collector: Collector{Type: Counter}}, &ok))
+
+	r.p.cfg.SanitizeNames = true
+	require.NoError(t, r.Declare(&NamedCollector{Name: "http.requests", Collector: Collector{Type: Counter}}, &ok))
+	require.NoError(t, r.Add(&Metric{Name: "http.requests", Value: 2}, &ok))
+
+	expected := `
+# HELP http_requests 
+# TYPE http_requests counter
+http_requests 2
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "http_requests"))
+}
+
+func Test_RPC_DeclareWithReply(t *testing.T) {
+	r := newTestRPC(t)
+
+	var out DeclareReply
+	require.NoError(t, r.DeclareWithReply(&NamedCollector{Name: "requests_total", Collector: Collector{Type: Counter, Namespace: "app", Subsystem: "http"}}, &out))
+	assert.Equal(t, DeclareReply{Name: "requests_total", FQName: "app_http_requests_total"}, out)
+
+	// the existing collector is reported as is
+	require.NoError(t, r.DeclareWithReply(&NamedCollector{Name: "requests_total", Collector: Collector{Type: Counter}}, &out))
+	assert.Equal(t, "app_http_requests_total", out.FQName)
+
+	r.p.cfg.SanitizeNames = true
+	require.NoError(t, r.DeclareWithReply(&NamedCollector{Name: "jobs.done", Collector: Collector{Type: Counter, Namespace: "my-app"}}, &out))
+	assert.Equal(t, DeclareReply{Name: "jobs.done", FQName: "my_app_jobs_done"}, out)
+
+	n, err := testutil.GatherAndCount(r.p.registry, "app_http_requests_total", "my_app_jobs_done")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	err = r.DeclareWithReply(&NamedCollector{Name: "invalid", Collector: Collector{Type: "unknown"}}, &out)
+	assert.Error(t, err)
+}
+
+func Test_RPC_SetEnumConcurrent(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	states := []string{"closed", "open", "half_open"}
+	require.NoError(t, r.Declare(&NamedCollector{Name: "breaker_state", Collector: Collector{
+		Type:   Gauge,
+		Labels: []string{"state"},
+		Enum:   &Enum{Label: "state", States: states},
+	}}, &ok))
+
+	for range 200 {
+		var wg sync.WaitGroup
+		for i := range 4 * len(states) {
+			state := states[i%len(states)]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var ok bool
+				assert.NoError(t, r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state"}, State: state}, &ok))
+			}()
+		}
+		wg.Wait()
+
+		mfs, err := r.p.registry.Gather()
+		require.NoError(t, err)
+		require.Len(t, mfs, 1)
+
+		var active float64
+		for _, m := range mfs[0].GetMetric() {
+			active += m.GetGauge().GetValue()
+		}
+		require.Equal(t, float64(1), active)
+	}
+}
+
+func Test_RPC_SetEnumCardinality(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "breaker_state", Collector: Collector{
+		Type:           Gauge,
+		Labels:         []string{"state", "breaker"},
+		Enum:           &Enum{Label: "state", States: []string{"closed", "open", "half_open"}},
+		MaxCardinality: 4,
+	}}, &ok))
+	require.NoError(t, r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"payments"}}, State: "open"}, &ok))
+
+	// the half_open series has expired and the other series took its slot
+	c, _ := r.p.collectors.Load("breaker_state")
+	col := c.(*collector)
+	vec := col.col.(*prometheus.GaugeVec)
+	vec.DeleteLabelValues("half_open", "payments")
+	col.forget([]string{"half_open", "payments"})
+	require.NoError(t, r.Set(&Metric{Name: "breaker_state", Labels: []string{"closed", "search"}}, &ok))
+	require.NoError(t, r.Set(&Metric{Name: "breaker_state", Labels: []string{"open", "search"}}, &ok))
+
+	// the rejected transition leaves the previous state active
+	err := r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"payments"}}, State: "closed"}, &ok)
+	assert.Equal(t, CodeCardinalityLimit, Code(err))
+	assert.Equal(t, float64(1), testutil.ToFloat64(vec.WithLabelValues("open", "payments")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(vec.WithLabelValues("closed", "payments")))
+}
+
+func Test_RPC_SetEnum(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "breaker_state", Collector: Collector{
+		Type:   Gauge,
+		Labels: []string{"state", "breaker"},
+		Enum:   &Enum{Label: "state", States: []string{"closed", "open", "half_open"}},
+	}}, &ok))
+
+	require.NoError(t, r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"payments"}}, State: "open"}, &ok))
+	require.NoError(t, r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"payments"}}, State: "half_open"}, &ok))
+	require.NoError(t, r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", LabelMap: map[string]string{"breaker": "search"}}, State: "closed"}, &ok))
+
+	expected := `
+# HELP breaker_state 
+# TYPE breaker_state gauge
+breaker_state{breaker="payments",state="closed"} 0
+breaker_state{breaker="payments",state="half_open"} 1
+breaker_state{breaker="payments",state="open"} 0
+breaker_state{breaker="search",state="closed"} 1
+breaker_state{breaker="search",state="half_open"} 0
+breaker_state{breaker="search",state="open"} 0
+`
+	require.NoError(t, testutil.GatherAndCompare(r.p.registry, strings.NewReader(expected), "breaker_state"))
+
+	err := r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"payments"}}, State: "broken"}, &ok)
+	assert.Equal(t, CodeInvalidValue, Code(err))
+
+	err = r.SetEnum(&EnumMetric{Metric: Metric{Name: "breaker_state", Labels: []string{"open", "payments"}}, State: "open"}, &ok)
+	assert.Equal(t, CodeInvalidLabels, Code(err))
+
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue_size", Collector: Collector{Type: Gauge, Labels: []string{"queue"}}}, &ok))
+	err = r.SetEnum(&EnumMetric{Metric: Metric{Name: "queue_size"}, State: "open"}, &ok)
+	assert.Equal(t, CodeUnsupportedMethod, Code(err))
+
+	for _, e := range []*Enum{
+		{Label: "missing", States: []string{"open"}},
+		{Label: "state"},
+		{Label: "state", States: []string{"open", "open"}},
+	} {
+		err = r.Declare(&NamedCollector{Name: "invalid", Collector: Collector{Type: Gauge, Labels: []string{"state"}, Enum: e}}, &ok)
+		assert.Equal(t, CodeInvalidCollector, Code(err), e)
+	}
+}
+
+func Test_RPC_SetEnabled(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "jobs_total", Collector: Collector{Type: Counter, Help: "Jobs."}}, &ok))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "queue_size", Collector: Collector{Type: Gauge, Help: "Queue."}}, &ok))
+	require.NoError(t, r.Inc("jobs_total", &ok))
+	require.NoError(t, r.Set(&Metric{Name: "queue_size", Value: 5}, &ok))
+
+	require.NoError(t, r.SetEnabled(&CollectorState{Name: "jobs_total"}, &ok))
+	// the disabled collector keeps accepting the updates
+	require.NoError(t, r.Inc("jobs_total", &ok))
+
+	var out []byte
+	require.NoError(t, r.Gather(struct{}{}, &out))
+	assert.NotContains(t, string(out), "jobs_total")
+	assert.Contains(t, string(out), "queue_size 5\n")
+
+	var infos []CollectorInfo
+	require.NoError(t, r.List(struct{}{}, &infos))
+	require.Len(t, infos, 2)
+	assert.True(t, infos[0].Disabled)
+	assert.False(t, infos[1].Disabled)
+
+	require.NoError(t, r.SetEnabled(&CollectorState{Name: "jobs_total", Enabled: true}, &ok))
+	require.NoError(t, r.Gather(struct{}{}, &out))
+	assert.Contains(t, string(out), "jobs_total 2\n")
+
+	// the histogram mirror is skipped along with its summary
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency", Collector: Collector{
+		Type:              Summary,
+		Namespace:         "app",
+		MirrorAsHistogram: &HistogramMirror{Buckets: []float64{1}},
+	}}, &ok))
+	require.NoError(t, r.Observe(&Metric{Name: "latency", Value: 0.5}, &ok))
+	require.NoError(t, r.SetEnabled(&CollectorState{Name: "latency"}, &ok))
+	require.NoError(t, r.Gather(struct{}{}, &out))
+	assert.NotContains(t, string(out), "app_latency")
+	assert.Contains(t, string(out), "jobs_total 2\n")
+
+	require.NoError(t, r.SetEnabled(&CollectorState{Name: "latency", Enabled: true}, &ok))
+	require.NoError(t, r.Gather(struct{}{}, &out))
+	assert.Contains(t, string(out), "app_latency_count 1\n")
+	assert.Contains(t, string(out), "app_latency_histogram_count 1\n")
+
+	err := r.SetEnabled(&CollectorState{Name: "missing"}, &ok)
+	assert.Equal(t, CodeUndefinedCollector, Code(err))
+}
+
+func Test_RPC_ObserveDurationNanos(t *testing.T) {
+	r := newTestRPC(t)
+
+	var ok bool
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency_seconds", Collector: Collector{Type: Histogram, Buckets: []float64{0.5, 1, 5}}}, &ok))
+
+	// the worker measured duration wins over the start, which would include the transport delay
+	require.NoError(t, r.ObserveDuration(&Metric{
+		Name:          "latency_seconds",
+		DurationNanos: int64(time.Millisecond * 750),
+		Start:         time.Now().Add(-time.Second * 10).UnixNano(),
+	}, &ok))
+	assert.Equal(t, CodeInvalidValue, Code(r.ObserveDuration(&Metric{Name: "latency_seconds", DurationNanos: -1}, &ok)))
+
+	families, err := r.p.registry.Gather()
+	require.NoError(t, err)
+	h := families[0].GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(1), h.GetSampleCount())
+	assert.Equal(t, 0.75, h.GetSampleSum())
+	assert.Equal(t, uint64(1), h.GetBucket()[1].GetCumulativeCount())
+}
+
+func Test_RPC_EnforceUnits(t *testing.T) {
+	r := newTestRPC(t)
+	r.p.cfg.EnforceUnits = true
+
+	var ok bool
+	err := r.Declare(&NamedCollector{Name: "latency_ms", Collector: Collector{Type: Histogram}}, &ok)
+	assert.Equal(t, CodeInvalidCollector, Code(err))
+	require.NoError(t, r.Declare(&NamedCollector{Name: "latency_seconds", Collector: Collector{Type: Histogram}}, &ok))
+}
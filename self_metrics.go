@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfNamespace is used for the plugin's own metrics, so they do not collide with the user collectors.
+const selfNamespace = "rr_metrics"
+
+// Version of the plugin, reported by the build_info metric. Injected at build time:
+// -ldflags "-X github.com/roadrunner-server/metrics/v5.Version=v5.0.0"
+var Version = "unknown"
+
+// selfMetrics instruments the plugin itself.
+type selfMetrics struct {
+	rpcCalls             *prometheus.CounterVec
+	rpcDuration          *prometheus.HistogramVec
+	registeredCollectors prometheus.Gauge
+	declareErrors        prometheus.Counter
+	buildInfo            *prometheus.GaugeVec
+	highCardinality      *prometheus.CounterVec
+	lastScrape           prometheus.Gauge
+	scrapeDuration       *prometheus.HistogramVec
+	scrapeSize           *prometheus.HistogramVec
+	// series is registered only when series_interval is set
+	series prometheus.Gauge
+}
+
+func newSelfMetrics() *selfMetrics {
+	s := &selfMetrics{
+		rpcCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Name:      "rpc_calls_total",
+			Help:      "Total number of metrics RPC calls by method and status.",
+		}, []string{"method", "status"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Duration of metrics RPC calls by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		registeredCollectors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Name:      "registered_collectors",
+			Help:      "Number of collectors declared via configuration and RPC.",
+		}),
+		declareErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Name:      "declare_errors_total",
+			Help:      "Total number of collectors which failed to register on Declare.",
+		}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Name:      "build_info",
+			Help:      "Build information of the metrics plugin, always 1.",
+		}, []string{"version", "go_version"}),
+		highCardinality: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Name:      "high_cardinality_warnings_total",
+			Help:      "Total number of collectors which crossed the cardinality_warning_ratio of their max_cardinality.",
+		}, []string{"collector"}),
+		lastScrape: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Name:      "last_scrape_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful scrape of the metrics endpoint.",
+		}),
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Name:      "scrape_duration_seconds",
+			Help:      "Duration of the requests to the metrics endpoint by status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"code"}),
+		scrapeSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Name:      "scrape_response_size_bytes",
+			Help:      "Size of the responses of the metrics endpoint by status code.",
+			// 1KiB to 16MiB
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}, []string{"code"}),
+		series: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Name:      "series_total",
+			Help:      "Number of the exposed time series, counted every series_interval.",
+		}),
+	}
+
+	s.buildInfo.WithLabelValues(Version, runtime.Version()).Set(1)
+
+	return s
+}
+
+func (s *selfMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.rpcCalls, s.rpcDuration, s.registeredCollectors, s.declareErrors, s.buildInfo, s.highCardinality, s.lastScrape, s.scrapeDuration, s.scrapeSize}
+}
+
+// observeRPC records the outcome of the RPC call, should be deferred with the named error result of the method.
+func (s *selfMetrics) observeRPC(method string, start time.Time, err *error) {
+	status := "success"
+	if *err != nil {
+		status = "error"
+	}
+
+	s.rpcCalls.WithLabelValues(method, status).Inc()
+	s.rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// seriesCounter periodically counts the exposed time series, a proxy of the registry size for the capacity planning.
+type seriesCounter struct {
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	gauge    prometheus.Gauge
+	log      *zap.Logger
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSeriesCounter(interval time.Duration, g prometheus.Gatherer, gauge prometheus.Gauge, log *zap.Logger) *seriesCounter {
+	return &seriesCounter{
+		interval: interval,
+		gatherer: g,
+		gauge:    gauge,
+		log:      log,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// start counts in a single goroutine, so the gathers never overlap.
+func (sc *seriesCounter) start() {
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+
+		ticker := time.NewTicker(sc.interval)
+		defer ticker.Stop()
+
+		sc.count()
+		for {
+			select {
+			case <-ticker.C:
+				sc.count()
+			case <-sc.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (sc *seriesCounter) stop() {
+	close(sc.stopCh)
+	sc.wg.Wait()
+}
+
+func (sc *seriesCounter) count() {
+	mfs, err := sc.gatherer.Gather()
+	if err != nil {
+		// the families which were gathered are still counted
+		sc.log.Debug("failed to gather some metrics for the series count", zap.Error(err))
+	}
+
+	sc.gauge.Set(float64(countSeries(mfs)))
+}
+
+// countSeries counts the series as exposed in the text format: every bucket and quantile of the histograms and
+// summaries is a series, as well as their _sum and _count.
+func countSeries(mfs []*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.Histogram != nil:
+				buckets := m.Histogram.GetBucket()
+				n += len(buckets) + 2
+				// the +Inf bucket is implicit
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+					n++
+				}
+			case m.Summary != nil:
+				n += len(m.Summary.GetQuantile()) + 2
+			default:
+				n++
+			}
+		}
+	}
+
+	return n
+}
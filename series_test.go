@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_SeriesCounter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"code"})
+	counter.WithLabelValues("200").Inc()
+	counter.WithLabelValues("500").Inc()
+
+	// 3 buckets + the +Inf bucket + _sum + _count
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Help: "Latency.", Buckets: []float64{0.1, 0.5, 1}})
+	histogram.Observe(0.2)
+
+	// 2 quantiles + _sum + _count
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "size", Help: "Size.", Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01}})
+	summary.Observe(1)
+
+	reg.MustRegister(counter, histogram, summary)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "series_total", Help: "Series."})
+	sc := newSeriesCounter(time.Millisecond*10, reg, gauge, zap.NewNop())
+	sc.start()
+	t.Cleanup(sc.stop)
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(gauge) == 12
+	}, time.Second*5, time.Millisecond*10)
+
+	counter.WithLabelValues("404").Inc()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(gauge) == 13
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func Test_SeriesCounter_Plugin(t *testing.T) {
+	p := newTestPlugin(&Config{SeriesInterval: time.Millisecond * 10})
+	assert.Error(t, (&Config{SeriesInterval: -time.Second}).validate())
+
+	p.series = newSeriesCounter(p.cfg.SeriesInterval, p.gatherer(), p.selfMetrics.series, p.log)
+	p.series.start()
+	t.Cleanup(p.series.stop)
+
+	p.registry.MustRegister(p.selfMetrics.series)
+	// the gauge counts itself
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(p.selfMetrics.series) == 1
+	}, time.Second*5, time.Millisecond*10)
+}
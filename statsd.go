@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// statsdMaxPacket keeps the datagrams within the typical MTU
+	statsdMaxPacket = 1432
+
+	statsdCounter   = "c"
+	statsdGauge     = "g"
+	statsdHistogram = "h"
+	statsdTiming    = "ms"
+)
+
+// statsd mirrors the RPC operations to the StatsD (or DogStatsD) endpoint, the lines are batched and flushed periodically.
+type statsd struct {
+	cfg  *StatsD
+	log  *zap.Logger
+	conn net.Conn
+
+	mu  sync.Mutex
+	buf []byte
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newStatsD(cfg *StatsD, log *zap.Logger) (*statsd, error) {
+	// UDP dial does not send anything, an unavailable endpoint does not fail the plugin
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsd{
+		cfg:    cfg,
+		log:    log,
+		conn:   conn,
+		buf:    make([]byte, 0, statsdMaxPacket),
+		stopCh: make(chan struct{}),
+	}, nil
+}
+
+// start flushing the batched lines in the background.
+func (s *statsd) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.cfg.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				s.flush()
+				s.mu.Unlock()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stop the background flushes and send the remaining lines.
+func (s *statsd) stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	s.flush()
+	s.mu.Unlock()
+
+	_ = s.conn.Close()
+}
+
+// send a single line, e.g. requests:1|c|#method:GET. Tags are only sent in the DogStatsD format.
+func (s *statsd) send(name string, value string, typ string, tags map[string]string) {
+	line := make([]byte, 0, 64)
+	line = append(line, s.cfg.Prefix...)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, typ...)
+
+	if s.cfg.DogStatsD && len(tags)+len(s.cfg.Tags) > 0 {
+		line = append(line, "|#"...)
+		line = appendTags(line, s.cfg.Tags, false)
+		line = appendTags(line, tags, len(s.cfg.Tags) > 0)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buf) > 0 && len(s.buf)+len(line)+1 > statsdMaxPacket {
+		s.flush()
+	}
+
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// flush the batched lines, should be called under mu.
+func (s *statsd) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+
+	_, err := s.conn.Write(s.buf)
+	if err != nil {
+		s.log.Debug("failed to send metrics to statsd", zap.String("address", s.cfg.Address), zap.Error(err))
+	}
+
+	s.buf = s.buf[:0]
+}
+
+// appendTags appends the tags sorted by name, so the lines are stable.
+func appendTags(line []byte, tags map[string]string, comma bool) []byte {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if comma {
+			line = append(line, ',')
+		}
+		comma = true
+
+		line = append(line, name...)
+		line = append(line, ':')
+		// the separators of the DogStatsD format can't be escaped
+		line = append(line, strings.NewReplacer("|", "_", ",", "_", "#", "_").Replace(tags[name])...)
+	}
+
+	return line
+}
+
+// statsdValue formats the value, relative gauge updates are prefixed with the sign.
+func statsdValue(v float64, relative bool) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if relative && v >= 0 {
+		return "+" + s
+	}
+
+	return s
+}
+
+// statsdOp is the RPC operation mirrored to StatsD.
+type statsdOp int
+
+const (
+	statsdAdd statsdOp = iota
+	statsdSub
+	statsdSet
+	statsdObserve
+	// statsdObserveDuration is the observation of ObserveDuration, in seconds
+	statsdObserveDuration
+)
+
+// target returns the StatsD name and the tags of the metric.
+func (s *statsd) target(col *collector, m *Metric) (string, map[string]string) {
+	name := prometheus.BuildFQName(col.def.Namespace, col.def.Subsystem, m.Name)
+
+	var tags map[string]string
+	if values := col.labelValues(m); len(values) == len(col.def.Labels) {
+		tags = make(map[string]string, len(values))
+		for i, label := range col.def.Labels {
+			tags[label] = values[i]
+		}
+	}
+
+	return name, tags
+}
+
+// mirror the RPC operation on the collector to StatsD.
+func (s *statsd) mirror(col *collector, m *Metric, op statsdOp, value float64) {
+	name, tags := s.target(col, m)
+
+	switch op {
+	case statsdAdd:
+		if col.def.Type == Counter {
+			s.send(name, statsdValue(value, false), statsdCounter, tags)
+			return
+		}
+
+		s.send(name, statsdValue(value, true), statsdGauge, tags)
+	case statsdSub:
+		s.send(name, statsdValue(-value, true), statsdGauge, tags)
+	case statsdSet:
+		if col.def.Type == Info {
+			return
+		}
+
+		// negative values are relative in StatsD, the gauge has to be reset first
+		if value < 0 {
+			s.send(name, "0", statsdGauge, tags)
+		}
+
+		s.send(name, statsdValue(value, false), statsdGauge, tags)
+	case statsdObserve, statsdObserveDuration:
+		value, typ := s.observation(name, op, value)
+		s.send(name, value, typ, tags)
+	}
+}
+
+// mirrorBulk mirrors the bulk observations, each as a single line sampled at 1/count, which the StatsD server scales
+// back to count observations. So a bulk of a million observations is not expanded into a million lines.
+func (s *statsd) mirrorBulk(col *collector, m *Metric, observations []Observation) {
+	name, tags := s.target(col, m)
+	for _, o := range observations {
+		if o.Count == 0 {
+			continue
+		}
+
+		value, typ := s.observation(name, statsdObserve, o.Value)
+		if o.Count > 1 {
+			// the sample rate precedes the tags
+			typ += "|@" + strconv.FormatFloat(1/float64(o.Count), 'f', -1, 64)
+		}
+
+		s.send(name, value, typ, tags)
+	}
+}
+
+// observation formats the observed value and its StatsD type.
+func (s *statsd) observation(name string, op statsdOp, value float64) (string, string) {
+	if s.cfg.DogStatsD {
+		return statsdValue(value, false), statsdHistogram
+	}
+
+	// the durations are observed in seconds, the timings are in milliseconds. The other observations (e.g. bytes)
+	// are sent as is, the unit of the collector is unknown.
+	if op == statsdObserveDuration || strings.HasSuffix(name, "_seconds") {
+		value *= 1000
+	}
+
+	return statsdValue(value, false), statsdTiming
+}
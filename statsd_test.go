@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_StatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	cfg := &StatsD{Address: conn.LocalAddr().String(), Prefix: "rr.", FlushInterval: time.Hour, Tags: map[string]string{"env": "test"}, DogStatsD: true}
+	s, err := newStatsD(cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	requests := &collector{def: Collector{Type: Counter, Namespace: "app", Labels: []string{"method"}}}
+	queue := &collector{def: Collector{Type: Gauge}}
+	latency := &collector{def: Collector{Type: Histogram}}
+
+	s.mirror(requests, &Metric{Name: "requests", Labels: []string{"GET"}}, statsdAdd, 2)
+	s.mirror(queue, &Metric{Name: "queue"}, statsdSub, 3)
+	s.mirror(queue, &Metric{Name: "queue"}, statsdSet, -1)
+	s.mirror(latency, &Metric{Name: "latency"}, statsdObserve, 0.25)
+	s.mirrorBulk(latency, &Metric{Name: "latency"}, []Observation{{Value: 0.5, Count: 2}})
+	s.stop()
+
+	buf := make([]byte, statsdMaxPacket)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"rr.app_requests:2|c|#env:test,method:GET",
+		"rr.queue:-3|g|#env:test",
+		"rr.queue:0|g|#env:test",
+		"rr.queue:-1|g|#env:test",
+		"rr.latency:0.25|h|#env:test",
+		"rr.latency:0.5|h|@0.5|#env:test",
+	}, strings.Split(string(buf[:n]), "\n"))
+}
+
+func Test_StatsD_Timing(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	s, err := newStatsD(&StatsD{Address: conn.LocalAddr().String(), FlushInterval: time.Hour}, zap.NewNop())
+	require.NoError(t, err)
+
+	// only the durations are converted to milliseconds
+	s.mirror(&collector{def: Collector{Type: Histogram}}, &Metric{Name: "latency_seconds"}, statsdObserve, 0.25)
+	s.mirror(&collector{def: Collector{Type: Histogram}}, &Metric{Name: "latency"}, statsdObserveDuration, 0.25)
+	s.mirror(&collector{def: Collector{Type: Histogram}}, &Metric{Name: "payload_bytes"}, statsdObserve, 512)
+	// the bulk observations are sampled rather than expanded
+	s.mirrorBulk(&collector{def: Collector{Type: Histogram}}, &Metric{Name: "latency_seconds"}, []Observation{
+		{Value: 0.5, Count: 1_000_000},
+		{Value: 1, Count: 1},
+		{Value: 2},
+	})
+	s.stop()
+
+	buf := make([]byte, statsdMaxPacket)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"latency_seconds:250|ms",
+		"latency:250|ms",
+		"payload_bytes:512|ms",
+		"latency_seconds:500|ms|@0.000001",
+		"latency_seconds:1000|ms",
+	}, strings.Split(string(buf[:n]), "\n"))
+}
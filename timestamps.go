@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// timestamped stamps every sample without an explicit timestamp with the gather time, for the pipelines which relay
+// the samples through a buffer and can't rely on the ingestion time.
+func timestamped(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		ts := time.Now().UnixMilli()
+		out := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			metrics := make([]*dto.Metric, 0, len(mf.GetMetric()))
+			for _, m := range mf.GetMetric() {
+				if m.TimestampMs != nil {
+					metrics = append(metrics, m)
+					continue
+				}
+
+				// the gathered families may be cached by the gatherer, so they are not modified in place
+				metrics = append(metrics, &dto.Metric{
+					Label:       m.Label,
+					Gauge:       m.Gauge,
+					Counter:     m.Counter,
+					Summary:     m.Summary,
+					Untyped:     m.Untyped,
+					Histogram:   m.Histogram,
+					TimestampMs: &ts,
+				})
+			}
+
+			out = append(out, &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Unit:   mf.Unit,
+				Metric: metrics,
+			})
+		}
+
+		return out, err
+	})
+}
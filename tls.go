@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"golang.org/x/sys/cpu"
+)
+
+const (
+	// TLSVersion12 is the default minimal TLS version.
+	TLSVersion12 string = "1.2"
+	// TLSVersion13 disables the older versions, the cipher suites of TLS 1.3 are not configurable.
+	TLSVersion13 string = "1.3"
+)
+
+// defaultCipherSuites prefers the suites which are fast on the current hardware.
+func defaultCipherSuites() []uint16 {
+	var topCipherSuites []uint16
+	var defaultCipherSuitesTLS13 []uint16
+
+	hasGCMAsmAMD64 := cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	hasGCMAsmARM64 := cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	// Keep in sync with crypto/aes/cipher_s390x.go.
+	hasGCMAsmS390X := cpu.S390X.HasAES && cpu.S390X.HasAESCBC && cpu.S390X.HasAESCTR && (cpu.S390X.HasGHASH || cpu.S390X.HasAESGCM)
+
+	hasGCMAsm := hasGCMAsmAMD64 || hasGCMAsmARM64 || hasGCMAsmS390X
+
+	if hasGCMAsm {
+		// If AES-GCM hardware is provided, then prioritize AES-GCM
+		// cipher suites.
+		topCipherSuites = []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		}
+		defaultCipherSuitesTLS13 = []uint16{
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+		}
+	} else {
+		// Without AES-GCM hardware, we put the ChaCha20-Poly1305
+		// cipher suites first.
+		topCipherSuites = []uint16{
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		}
+		defaultCipherSuitesTLS13 = []uint16{
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+		}
+	}
+
+	DefaultCipherSuites := make([]uint16, 0, 22)
+	DefaultCipherSuites = append(DefaultCipherSuites, topCipherSuites...)
+	DefaultCipherSuites = append(DefaultCipherSuites, defaultCipherSuitesTLS13...)
+
+	return DefaultCipherSuites
+}
+
+// cipherSuiteIDs resolves the cipher suite names, only the secure TLS 1.2 suites are allowed.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := tls12CipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS 1.2 cipher suite `%s`", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func tls12CipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+
+		for _, v := range cs.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return cs.ID, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func (t *TLS) validate() error {
+	if t.Cert == "" || t.Key == "" {
+		return fmt.Errorf("tls: cert and key should not be empty")
+	}
+
+	if _, err := tls.LoadX509KeyPair(t.Cert, t.Key); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	switch t.MinVersion {
+	case TLSVersion12:
+		if _, err := cipherSuiteIDs(t.CipherSuites); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	case TLSVersion13:
+		if len(t.CipherSuites) > 0 {
+			return fmt.Errorf("tls: cipher_suites can't be set with min_version %s, TLS 1.3 suites are not configurable", TLSVersion13)
+		}
+	default:
+		return fmt.Errorf("tls: unknown min_version `%s`, should be either %s or %s", t.MinVersion, TLSVersion12, TLSVersion13)
+	}
+
+	return nil
+}
+
+// tlsConfig of the metrics servers, the defaults are used for the options which are not configured.
+func (p *Plugin) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+			tls.CurveP384,
+			tls.CurveP521,
+		},
+		CipherSuites: defaultCipherSuites(),
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	t := p.cfg.TLS
+	if t == nil {
+		return cfg
+	}
+
+	if t.MinVersion == TLSVersion13 {
+		cfg.MinVersion = tls.VersionTLS13
+	}
+
+	if len(t.CipherSuites) > 0 {
+		// validated on Init
+		cfg.CipherSuites, _ = cipherSuiteIDs(t.CipherSuites)
+	}
+
+	return cfg
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes the self-signed certificate for 127.0.0.1 and its key into the temporary directory.
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metrics"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	cert, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return cert, keyPath
+}
+
+func Test_TLS_Validate(t *testing.T) {
+	cert, key := writeTestCert(t)
+
+	tests := []struct {
+		name string
+		tls  *TLS
+		err  string
+	}{
+		{name: "defaults", tls: &TLS{Cert: cert, Key: key}},
+		{name: "tls13", tls: &TLS{Cert: cert, Key: key, MinVersion: TLSVersion13}},
+		{name: "suites", tls: &TLS{Cert: cert, Key: key, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}},
+		{name: "no key", tls: &TLS{Cert: cert}, err: "cert and key"},
+		{name: "missing cert", tls: &TLS{Cert: cert + ".missing", Key: key}, err: "no such file"},
+		{name: "version", tls: &TLS{Cert: cert, Key: key, MinVersion: "1.1"}, err: "unknown min_version"},
+		{name: "unknown suite", tls: &TLS{Cert: cert, Key: key, CipherSuites: []string{"TLS_FOO"}}, err: "TLS_FOO"},
+		{name: "insecure suite", tls: &TLS{Cert: cert, Key: key, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: "insecure"},
+		{name: "tls13 suite", tls: &TLS{Cert: cert, Key: key, CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, err: "TLS_AES_128_GCM_SHA256"},
+		{name: "tls13 with suites", tls: &TLS{Cert: cert, Key: key, MinVersion: TLSVersion13, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, err: "not configurable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{TLS: tt.tls}
+			c.InitDefaults()
+
+			err := c.validate()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func Test_TLS_Serve(t *testing.T) {
+	cert, key := writeTestCert(t)
+
+	p := newTestPlugin(&Config{Address: "127.0.0.1:0", TLS: &TLS{Cert: cert, Key: key, MinVersion: TLSVersion13}})
+	require.NoError(t, p.cfg.validate())
+	assert.Equal(t, uint16(tls.VersionTLS13), p.tlsConfig().MinVersion)
+
+	errCh := p.Serve()
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second*5, time.Millisecond*10)
+
+	url := "https://" + p.Addr().String() + "/metrics"
+	newClient := func(maxVersion uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			MaxVersion:         maxVersion,
+		}}}
+	}
+
+	resp, err := newClient(tls.VersionTLS13).Get(url) //nolint:noctx
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+
+	// TLS 1.2 is rejected with min_version 1.3
+	_, err = newClient(tls.VersionTLS12).Get(url) //nolint:noctx,bodyclose
+	assert.Error(t, err)
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected serve error: %v", err)
+	default:
+	}
+}
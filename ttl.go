@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelDeleter is implemented by all vector collectors.
+type labelDeleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// seriesTTL tracks the last update of every child series of a vector collector and deletes the stale ones.
+type seriesTTL struct {
+	vec      labelDeleter
+	ttl      time.Duration
+	interval time.Duration
+
+	mu       sync.Mutex
+	lastSeen map[string]series
+	// deleted is notified about every expired series, optional
+	deleted func(labels []string)
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+type series struct {
+	labels  []string
+	updated time.Time
+}
+
+// newSeriesTTL returns nil when the TTL is not set or the collector is not a vector.
+func newSeriesTTL(col prometheus.Collector, m *Collector) *seriesTTL {
+	vec, ok := col.(labelDeleter)
+	if m.TTL == 0 || !ok {
+		return nil
+	}
+
+	interval := m.SweepInterval
+	if interval == 0 {
+		interval = m.TTL / 2
+	}
+
+	return &seriesTTL{
+		vec:      vec,
+		ttl:      m.TTL,
+		interval: interval,
+		lastSeen: make(map[string]series),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// start sweeping the stale series in the background.
+func (s *seriesTTL) start() {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				s.sweep(now)
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (s *seriesTTL) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+// touch records the update of the series.
+func (s *seriesTTL) touch(labels []string) {
+	key := seriesKey(labels)
+
+	s.mu.Lock()
+	if sr, ok := s.lastSeen[key]; ok {
+		sr.updated = time.Now()
+		s.lastSeen[key] = sr
+	} else {
+		s.lastSeen[key] = series{labels: slices.Clone(labels), updated: time.Now()}
+	}
+	s.mu.Unlock()
+}
+
+// sweep deletes the series which were not updated within the TTL.
+func (s *seriesTTL) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sr := range s.lastSeen {
+		if now.Sub(sr.updated) < s.ttl {
+			continue
+		}
+
+		s.vec.DeleteLabelValues(sr.labels...)
+		delete(s.lastSeen, key)
+		if s.deleted != nil {
+			s.deleted(sr.labels)
+		}
+	}
+}
+
+// seriesKey identifies the series by its label values.
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}